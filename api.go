@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// recordsAPI serves GET, POST and DELETE on /records, query statistics on
+// GET /stats and the health check on GET /healthz. Changes go through
+// applyConfig, so they get the same validation as records loaded from path.
+type recordsAPI struct {
+	res     *Resolver
+	path    string
+	persist bool
+}
+
+func (res *Resolver) serveAPI(cfg APIConfig, path string) {
+	api := &recordsAPI{res: res, path: path, persist: cfg.Persist}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /records", api.list)
+	mux.HandleFunc("POST /records", api.add)
+	mux.HandleFunc("DELETE /records", api.remove)
+	mux.HandleFunc("GET /stats", api.stats)
+	mux.HandleFunc("GET /healthz", res.healthz)
+	go func() {
+		res.logger.Info("serving records API", "listen", cfg.Listen, "persist", cfg.Persist)
+		if err := http.ListenAndServe(cfg.Listen, mux); err != nil {
+			res.logger.Error("records API server failed", "listen", cfg.Listen, "err", err)
+		}
+	}()
+}
+
+func (api *recordsAPI) list(w http.ResponseWriter, req *http.Request) {
+	records := api.res.currentConfig().Records
+	if records == nil {
+		records = []DNSRecord{}
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+func (api *recordsAPI) add(w http.ResponseWriter, req *http.Request) {
+	var record DNSRecord
+	dec := json.NewDecoder(io.LimitReader(req.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&record); err != nil {
+		http.Error(w, "malformed record: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	api.res.editMu.Lock()
+	defer api.res.editMu.Unlock()
+	config := api.res.currentConfig()
+	for _, alias := range expandAliases([]DNSRecord{record}) {
+		if err := api.res.validateRecord(alias, config.Server.DefaultTTL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if api.persist {
+		err := editRecordsFile(api.path, config.fileRecords, func(_, seq *yaml.Node) error {
+			var node yaml.Node
+			if err := node.Encode(record); err != nil {
+				return err
+			}
+			seq.Content = append(seq.Content, &node)
+			return nil
+		})
+		if err != nil {
+			api.res.logger.Error("failed to persist records", "path", api.path, "err", err)
+			http.Error(w, "failed to persist records", http.StatusInternalServerError)
+			return
+		}
+		config.fileRecords++
+		record.fileIndex = config.fileRecords
+	}
+
+	config.Records = append(slices.Clip(config.Records), record)
+	api.res.applyConfig(config, api.path)
+	api.res.logger.Info("record added via API", "hostname", record.Hostname, "type", recordTypeName(strings.ToUpper(record.Type)))
+	writeJSON(w, http.StatusCreated, record)
+}
+
+// remove deletes every record for the hostname query parameter, narrowed to
+// one record type when type is given.
+func (api *recordsAPI) remove(w http.ResponseWriter, req *http.Request) {
+	hostname := req.URL.Query().Get("hostname")
+	if hostname == "" {
+		http.Error(w, "hostname is required", http.StatusBadRequest)
+		return
+	}
+	name, err := ownerName(hostname)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rrtype := strings.ToUpper(req.URL.Query().Get("type"))
+
+	api.res.editMu.Lock()
+	defer api.res.editMu.Unlock()
+	config := api.res.currentConfig()
+	// A record shared with aliases loses only this name, and stays in
+	// place for the others.
+	var kept []DNSRecord
+	var removed []int
+	shared := make(map[int]DNSRecord)
+	for i, record := range config.Records {
+		if !record.owns(name) || !matchesType(record, rrtype) {
+			kept = append(kept, record)
+			continue
+		}
+		removed = append(removed, i)
+		if rest, ok := record.without(name); ok {
+			kept = append(kept, rest)
+			shared[i] = rest
+		}
+	}
+	if len(removed) == 0 {
+		http.Error(w, "no matching records", http.StatusNotFound)
+		return
+	}
+	if api.persist {
+		// Records that aren't in the file, such as ones added without
+		// persist, are only removed from memory.
+		replace := make(map[int]*yaml.Node)
+		drop := make(map[int]bool)
+		var moved []int
+		err := editRecordsFile(api.path, config.fileRecords, func(_, seq *yaml.Node) error {
+			for _, i := range removed {
+				pos := config.Records[i].fileIndex - 1
+				rest, ok := shared[i]
+				switch {
+				case pos < 0:
+				case !ok:
+					drop[pos] = true
+				default:
+					node, err := recordNode(rest, seq.Content[pos])
+					if err != nil {
+						return err
+					}
+					replace[pos] = node
+				}
+			}
+			moved = rewriteRecords(seq, replace, drop, nil)
+			return nil
+		})
+		if err != nil {
+			api.res.logger.Error("failed to persist records", "path", api.path, "err", err)
+			http.Error(w, "failed to persist records", http.StatusInternalServerError)
+			return
+		}
+		for i := range kept {
+			if pos := kept[i].fileIndex - 1; pos >= 0 {
+				kept[i].fileIndex = moved[pos] + 1
+			}
+		}
+		config.fileRecords -= len(drop)
+	}
+
+	config.Records = kept
+	api.res.applyConfig(config, api.path)
+	api.res.logger.Info("records removed via API", "hostname", hostname, "count", len(removed))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// matchesType reports whether record has type rrtype. Untyped address records
+// match both A and AAAA, and an empty rrtype matches everything.
+func matchesType(record DNSRecord, rrtype string) bool {
+	own := strings.ToUpper(record.Type)
+	switch {
+	case rrtype == "", own == rrtype:
+		return true
+	case own == "":
+		return rrtype == "A" || rrtype == "AAAA"
+	}
+	return false
+}
+
+// validateRecord reports whether record would load cleanly alongside the
+// records currently being served.
+func (res *Resolver) validateRecord(record DNSRecord, defaultTTL uint32) error {
+	name, err := ownerName(record.Hostname)
+	if err != nil {
+		return err
+	}
+	ttl := defaultTTL
+	if record.TTL != nil {
+		ttl = *record.TTL
+	}
+	rrs, err := parseRecord(record, name, ttl)
+	if err != nil {
+		return err
+	}
+	views, err := parseViews(record, name, ttl)
+	if err != nil {
+		return err
+	}
+
+	host := &hostRecords{}
+	if existing, found := res.loaded().records[name]; found {
+		host.addresses = slices.Clone(existing.addresses)
+		host.views = slices.Clone(existing.views)
+		host.cname = existing.cname
+		host.records = slices.Clone(existing.records)
+	}
+	for _, rr := range rrs {
+		if err := host.add(rr); err != nil {
+			return err
+		}
+	}
+	for _, view := range views {
+		if err := host.addView(view); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// editRecordsFile applies edit to the records sequence of the YAML file at
+// path, keeping comments and the rest of the file intact. edit is also given
+// the file's top-level mapping. want is the number of records the file
+// should currently hold; if it differs, the file has changed since it was
+// loaded and is left alone.
+func editRecordsFile(path string, want int, edit func(root, seq *yaml.Node) error) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return errors.New("records file is not a YAML mapping")
+	}
+
+	var seq *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "records" {
+			seq = root.Content[i+1]
+		}
+	}
+	if seq == nil {
+		seq = &yaml.Node{Kind: yaml.SequenceNode}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "records"}, seq)
+	}
+	if seq.Kind == yaml.ScalarNode && seq.Tag == "!!null" {
+		seq.Kind, seq.Tag, seq.Value = yaml.SequenceNode, "", ""
+	}
+	if seq.Kind != yaml.SequenceNode || len(seq.Content) != want {
+		return fmt.Errorf("records in %s changed since they were loaded", path)
+	}
+	if err := edit(root, seq); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// recordNode encodes record as an entry of the records sequence, keeping the
+// comments of old, the node it replaces, if there is one.
+func recordNode(record DNSRecord, old *yaml.Node) (*yaml.Node, error) {
+	var node yaml.Node
+	if err := node.Encode(record); err != nil {
+		return nil, err
+	}
+	if old != nil {
+		node.HeadComment, node.LineComment, node.FootComment = old.HeadComment, old.LineComment, old.FootComment
+	}
+	return &node, nil
+}
+
+// rewriteRecords puts the nodes in replace in place of those at their
+// positions in the records sequence seq, drops the positions in drop and
+// appends added. It returns the new position of every old one, with -1 for
+// those dropped.
+func rewriteRecords(seq *yaml.Node, replace map[int]*yaml.Node, drop map[int]bool, added []*yaml.Node) []int {
+	moved := make([]int, len(seq.Content))
+	var content []*yaml.Node
+	for pos, node := range seq.Content {
+		moved[pos] = -1
+		if drop[pos] {
+			continue
+		}
+		if n, ok := replace[pos]; ok {
+			node = n
+		}
+		moved[pos] = len(content)
+		content = append(content, node)
+	}
+	seq.Content = append(content, added...)
+	return moved
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// blocklist holds names that are answered with NXDOMAIN, or with a sinkhole
+// address when one is configured. An entry of the form "*.example.com"
+// blocks every name beneath example.com but not example.com itself.
+type blocklist struct {
+	names    map[string]bool
+	sinkhole net.IP
+	ttl      uint32
+}
+
+func newBlocklist(cfg ServerConfig) (*blocklist, error) {
+	if len(cfg.Blocklist) == 0 {
+		return nil, nil
+	}
+
+	b := &blocklist{names: make(map[string]bool), ttl: cfg.DefaultTTL}
+	switch cfg.BlockMode {
+	case "nxdomain":
+	case "sinkhole":
+		b.sinkhole = net.ParseIP(cfg.SinkholeIP)
+		if b.sinkhole == nil {
+			return nil, fmt.Errorf("invalid sinkhole_ip %q", cfg.SinkholeIP)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported block_mode %q: must be nxdomain or sinkhole", cfg.BlockMode)
+	}
+
+	for _, name := range cfg.Blocklist {
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("blocklist entry %q is not a valid domain name", name)
+		}
+		b.names[dns.CanonicalName(name)] = true
+	}
+	return b, nil
+}
+
+func (b *blocklist) blocks(name string) bool {
+	name = dns.CanonicalName(name)
+	if b.names[name] {
+		return true
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if b.names["*."+name[off:]] {
+			return true
+		}
+	}
+	return false
+}
+
+// answer returns the sinkhole record for q, if the sinkhole address matches
+// the queried address family.
+func (b *blocklist) answer(q dns.Question) []dns.RR {
+	rr := addressRecord(q.Name, b.sinkhole, b.ttl)
+	if rr.Header().Rrtype != q.Qtype {
+		return nil
+	}
+	return []dns.RR{rr}
+}
+
+func (res *Resolver) currentBlocklist() *blocklist {
+	return res.loaded().blocklist
+}
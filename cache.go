@@ -0,0 +1,137 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// responseCache is a bounded LRU of upstream replies. Entries live for the
+// smallest TTL in their answer section and are served with TTLs reduced by
+// the time spent in the cache. Negative replies (NXDOMAIN or no answers) live
+// for their SOA's negative TTL, capped at negativeTTL.
+type responseCache struct {
+	mu          sync.Mutex
+	size        int
+	negativeTTL uint32
+	entries     map[cacheKey]*list.Element
+	lru         *list.List
+}
+
+func newResponseCache(size int, negativeTTL uint32) *responseCache {
+	return &responseCache{
+		size:        size,
+		negativeTTL: negativeTTL,
+		entries:     make(map[cacheKey]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// isNegative reports whether msg says the name doesn't exist or has no
+// records of the queried type.
+func isNegative(msg *dns.Msg) bool {
+	return msg.Rcode == dns.RcodeNameError || (msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0)
+}
+
+// ttl returns how long msg may be cached, or 0 if it shouldn't be. Negative
+// replies without an SOA carry no TTL and aren't cached (RFC 2308).
+func (c *responseCache) ttl(msg *dns.Msg) uint32 {
+	if msg.Truncated {
+		return 0
+	}
+	if isNegative(msg) {
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return min(soa.Hdr.Ttl, soa.Minttl, c.negativeTTL)
+			}
+		}
+		return 0
+	}
+	if msg.Rcode != dns.RcodeSuccess {
+		return 0
+	}
+	// The reply is only good while its shortest-lived record is, in
+	// whatever section it is.
+	ttl := msg.Answer[0].Header().Ttl
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				ttl = min(ttl, rr.Header().Ttl)
+			}
+		}
+	}
+	return ttl
+}
+
+func newCacheKey(q dns.Question) cacheKey {
+	return cacheKey{name: dns.CanonicalName(q.Name), qtype: q.Qtype}
+}
+
+func (c *responseCache) get(q dns.Question) *dns.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := newCacheKey(q)
+	elem, found := c.entries[key]
+	if !found {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+
+	msg := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl -= min(elapsed, rr.Header().Ttl)
+			}
+		}
+	}
+	return msg
+}
+
+func (c *responseCache) put(q dns.Question, msg *dns.Msg) {
+	ttl := c.ttl(msg)
+	if ttl == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	key := newCacheKey(q)
+	entry := &cacheEntry{key: key, msg: msg.Copy(), stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+	if elem, found := c.entries[key]; found {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
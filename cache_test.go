@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// TestCacheShortAuthorityTTL checks that a reply is cached no longer than
+// its shortest-lived record, even when that record isn't an answer, and
+// that no TTL wraps around as the entry ages.
+func TestCacheShortAuthorityTTL(t *testing.T) {
+	q := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	msg := new(dns.Msg)
+	msg.SetQuestion(q.Name, q.Qtype)
+	msg.Answer = []dns.RR{mustRR(t, "www.example.com. 300 IN A 192.0.2.1")}
+	msg.Ns = []dns.RR{mustRR(t, "example.com. 1 IN NS ns.example.com.")}
+	msg.Extra = []dns.RR{mustRR(t, "ns.example.com. 300 IN A 192.0.2.53")}
+
+	c := newResponseCache(10, 60)
+	if got := c.ttl(msg); got != 1 {
+		t.Fatalf("ttl = %d, want 1", got)
+	}
+	c.put(q, msg)
+	if c.get(q) == nil {
+		t.Fatal("fresh entry not cached")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if cached := c.get(q); cached != nil {
+		t.Fatalf("entry served after its NS expired: %v", cached)
+	}
+}
+
+// TestCacheTTLNeverWraps checks the age subtracted from cached records is
+// capped at each record's own TTL.
+func TestCacheTTLNeverWraps(t *testing.T) {
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}
+	msg := new(dns.Msg)
+	msg.SetQuestion(q.Name, q.Qtype)
+	msg.Rcode = dns.RcodeNameError
+	msg.Ns = []dns.RR{mustRR(t, "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 3600 600 604800 5")}
+	msg.Extra = []dns.RR{mustRR(t, "ns.example.com. 1 IN A 192.0.2.53")}
+
+	c := newResponseCache(10, 60)
+	c.put(q, msg)
+	time.Sleep(2100 * time.Millisecond)
+	cached := c.get(q)
+	if cached == nil {
+		t.Fatal("negative entry expired early")
+	}
+	for _, rr := range append(cached.Ns, cached.Extra...) {
+		if rr.Header().Ttl > 3600 {
+			t.Errorf("%s: TTL wrapped around to %d", rr.Header().Name, rr.Header().Ttl)
+		}
+	}
+}
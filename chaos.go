@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ChaosConfig sets the strings returned for the CH class TXT queries that
+// operators use to identify a server: Version for version.bind and
+// version.server, Hostname for hostname.bind and id.server. Names whose
+// string is empty, or all of them with Refuse set, are treated like any
+// other query in an unsupported class. Version defaults to a generic string
+// rather than the real build, and Hostname to empty.
+type ChaosConfig struct {
+	Version  string `yaml:"version"`
+	Hostname string `yaml:"hostname"`
+	Refuse   bool   `yaml:"refuse"`
+}
+
+// classRcode returns the RCODE sent for queries in a class other than IN.
+func classRcode(mode string) (int, error) {
+	switch mode {
+	case "refused":
+		return dns.RcodeRefused, nil
+	case "notimp":
+		return dns.RcodeNotImplemented, nil
+	}
+	return 0, fmt.Errorf("invalid unsupported_class %q: must be refused or notimp", mode)
+}
+
+// chaosAnswers answers q from the configured CH class strings. The boolean
+// reports whether q names one of them; other qtypes for those names get an
+// empty answer.
+func chaosAnswers(q dns.Question, cfg ChaosConfig) ([]dns.RR, bool) {
+	if q.Qclass != dns.ClassCHAOS || cfg.Refuse {
+		return nil, false
+	}
+	var txt string
+	switch strings.ToLower(q.Name) {
+	case "version.bind.", "version.server.":
+		txt = cfg.Version
+	case "hostname.bind.", "id.server.":
+		txt = cfg.Hostname
+	}
+	if txt == "" {
+		return nil, false
+	}
+	if q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY {
+		return nil, true
+	}
+	return []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: splitTXT(txt),
+	}}, true
+}
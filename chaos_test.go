@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// askClass is like ask, for a question in class qclass.
+func askClass(t *testing.T, res *Resolver, name string, qtype, qclass uint16) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	r.Question[0].Qclass = qclass
+	return exchangeWith(t, res, r)
+}
+
+// TestUnsupportedClass checks the RCODE sent for queries outside the IN
+// class, under each unsupported_class setting.
+func TestUnsupportedClass(t *testing.T) {
+	records := "records:\n  - hostname: printer.lan\n    ip: 10.0.0.5\n"
+	for mode, want := range map[string]int{"": dns.RcodeRefused, "refused": dns.RcodeRefused, "notimp": dns.RcodeNotImplemented} {
+		yml := records
+		if mode != "" {
+			yml = "server:\n  unsupported_class: " + mode + "\n" + records
+		}
+		res, _ := newTestResolver(t, yml)
+		for _, class := range []uint16{dns.ClassCHAOS, dns.ClassHESIOD} {
+			m := askClass(t, res, "printer.lan.", dns.TypeA, class)
+			if m.Rcode != want || len(m.Answer) != 0 {
+				t.Errorf("unsupported_class %q, class %s: rcode %s, %d answers", mode, dns.ClassToString[class], dns.RcodeToString[m.Rcode], len(m.Answer))
+			}
+		}
+	}
+
+	if _, err := classRcode("drop"); err == nil {
+		t.Error("unsupported_class: drop was accepted")
+	}
+}
+
+// TestChaosAnswers checks which CH class questions chaosAnswers answers.
+func TestChaosAnswers(t *testing.T) {
+	cfg := ChaosConfig{Version: "dns-server"}
+	for _, tt := range []struct {
+		name          string
+		qtype, qclass uint16
+		found         bool
+		answers       int
+	}{
+		{"version.bind.", dns.TypeTXT, dns.ClassCHAOS, true, 1},
+		{"VERSION.BIND.", dns.TypeTXT, dns.ClassCHAOS, true, 1},
+		{"version.bind.", dns.TypeANY, dns.ClassCHAOS, true, 1},
+		{"version.bind.", dns.TypeA, dns.ClassCHAOS, true, 0},
+		{"version.bind.", dns.TypeTXT, dns.ClassINET, false, 0},
+		{"other.bind.", dns.TypeTXT, dns.ClassCHAOS, false, 0},
+	} {
+		rrs, found := chaosAnswers(dns.Question{Name: tt.name, Qtype: tt.qtype, Qclass: tt.qclass}, cfg)
+		if found != tt.found || len(rrs) != tt.answers {
+			t.Errorf("%s %s %s: found %v, %d answers", tt.name, dns.ClassToString[tt.qclass], dns.TypeToString[tt.qtype], found, len(rrs))
+			continue
+		}
+		if tt.answers == 1 {
+			txt := rrs[0].(*dns.TXT)
+			if txt.Hdr.Class != dns.ClassCHAOS || txt.Hdr.Name != tt.name || len(txt.Txt) != 1 || txt.Txt[0] != "dns-server" {
+				t.Errorf("%s: answer %v", tt.name, txt)
+			}
+		}
+	}
+}
+
+// TestVersionBind checks that version.bind is answered through the
+// handler, authoritatively, while other CH names are refused.
+func TestVersionBind(t *testing.T) {
+	res, _ := newTestResolver(t, "records:\n  - hostname: printer.lan\n    ip: 10.0.0.5\n")
+	m := askClass(t, res, "version.bind.", dns.TypeTXT, dns.ClassCHAOS)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || !m.Authoritative {
+		t.Fatalf("version.bind: rcode %s, aa %v, answers %v", dns.RcodeToString[m.Rcode], m.Authoritative, m.Answer)
+	}
+	if txt := m.Answer[0].(*dns.TXT).Txt; txt[0] != "dns-server" {
+		t.Errorf("version.bind = %q", txt)
+	}
+	if m := askClass(t, res, "version.bind.", dns.TypeA, dns.ClassCHAOS); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("version.bind A: rcode %s, answers %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+}
+
+// TestChaosNames checks the identification names against the chaos
+// settings: each answers with its string, an empty string leaves its names
+// refused, and refuse turns them all off.
+func TestChaosNames(t *testing.T) {
+	records := "records:\n  - hostname: printer.lan\n    ip: 10.0.0.5\n"
+	for _, tt := range []struct {
+		desc, chaos string
+		want        map[string]string
+	}{
+		{"defaults", "", map[string]string{
+			"version.bind.": "dns-server", "version.server.": "dns-server", "hostname.bind.": "", "id.server.": "",
+		}},
+		{"configured", "    version: \"1.2\"\n    hostname: ns1\n", map[string]string{
+			"version.bind.": "1.2", "version.server.": "1.2", "hostname.bind.": "ns1", "id.server.": "ns1",
+		}},
+		{"refused", "    hostname: ns1\n    refuse: true\n", map[string]string{
+			"version.bind.": "", "version.server.": "", "hostname.bind.": "", "id.server.": "",
+		}},
+	} {
+		yml := records
+		if tt.chaos != "" {
+			yml = "server:\n  chaos:\n" + tt.chaos + records
+		}
+		res, _ := newTestResolver(t, yml)
+		for name, want := range tt.want {
+			m := askClass(t, res, name, dns.TypeTXT, dns.ClassCHAOS)
+			if want == "" {
+				if m.Rcode != dns.RcodeRefused || len(m.Answer) != 0 {
+					t.Errorf("%s: %s: rcode %s, answers %v; want REFUSED", tt.desc, name, dns.RcodeToString[m.Rcode], m.Answer)
+				}
+				continue
+			}
+			if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+				t.Errorf("%s: %s: rcode %s, %d answers", tt.desc, name, dns.RcodeToString[m.Rcode], len(m.Answer))
+				continue
+			}
+			if got := m.Answer[0].(*dns.TXT).Txt[0]; got != want {
+				t.Errorf("%s: %s = %q, want %q", tt.desc, name, got, want)
+			}
+		}
+	}
+}
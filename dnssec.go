@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Signatures are made when a query is answered. They are backdated a
+	// little to allow for clock skew and stay valid for a week, far longer
+	// than any TTL they could be cached for.
+	signatureSkew     = time.Hour
+	signatureValidity = 7 * 24 * time.Hour
+)
+
+// DNSSECConfig names the files of a zone's signing key, as written by
+// dnssec-keygen: the public DNSKEY record and its private key. Relative
+// paths are resolved against the directory of the records file.
+type DNSSECConfig struct {
+	Key        string `yaml:"key"`
+	PrivateKey string `yaml:"private_key"`
+}
+
+// zoneKey is the key a zone's answers are signed with.
+type zoneKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// loadZoneKey reads the signing key described by cfg for the zone whose SOA
+// is soa, and checks that its two halves belong together.
+func loadZoneKey(cfg DNSSECConfig, soa *dns.SOA, path string) (*zoneKey, error) {
+	if cfg.Key == "" || cfg.PrivateKey == "" {
+		return nil, errors.New("dnssec needs both key and private_key")
+	}
+	resolve := func(file string) string {
+		if filepath.IsAbs(file) {
+			return file
+		}
+		return filepath.Join(filepath.Dir(path), file)
+	}
+
+	data, err := os.ReadFile(resolve(cfg.Key))
+	if err != nil {
+		return nil, err
+	}
+	rr, err := dns.NewRR(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("dnssec key: %w", err)
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok || dnskey.Flags&dns.ZONE == 0 {
+		return nil, fmt.Errorf("dnssec key %s is not a zone DNSKEY record", cfg.Key)
+	}
+	if dns.CanonicalName(dnskey.Hdr.Name) != soa.Hdr.Name {
+		return nil, fmt.Errorf("dnssec key is for %s, not %s", dnskey.Hdr.Name, soa.Hdr.Name)
+	}
+	dnskey.Hdr.Name = soa.Hdr.Name
+	dnskey.Hdr.Ttl = soa.Hdr.Ttl
+
+	f, err := os.Open(resolve(cfg.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	private, err := dnskey.ReadPrivateKey(f, cfg.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("dnssec private key: %w", err)
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("dnssec private key %s can't be used for signing", cfg.PrivateKey)
+	}
+
+	key := &zoneKey{dnskey: dnskey, signer: signer}
+	sig, err := key.sign([]dns.RR{soa}, time.Now())
+	if err == nil {
+		err = sig.Verify(dnskey, []dns.RR{soa})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dnssec private key doesn't match the DNSKEY: %w", err)
+	}
+	return key, nil
+}
+
+// sign returns an RRSIG over rrset, which must all share one name and type.
+func (key *zoneKey) sign(rrset []dns.RR, now time.Time) (*dns.RRSIG, error) {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  key.dnskey.Algorithm,
+		Expiration: uint32(now.Add(signatureValidity).Unix()),
+		Inception:  uint32(now.Add(-signatureSkew).Unix()),
+		KeyTag:     key.dnskey.KeyTag(),
+		SignerName: key.dnskey.Hdr.Name,
+	}
+	return sig, sig.Sign(key.signer, rrset)
+}
+
+// signResponse adds DNSSEC records to m, the answer to q built from the
+// local records, for a client that set the DO bit: an RRSIG after every
+// RRset in the answer and authority sections that lies in a signed zone, and
+// for negative answers the NSEC records proving that the name or type
+// doesn't exist.
+func (res *Resolver) signResponse(m *dns.Msg, q dns.Question) {
+	snap := res.loaded()
+	if len(m.Answer) == 0 {
+		if z := encloser(snap.zones, dns.CanonicalName(q.Name)); z != nil && z.key != nil {
+			m.Ns = append(m.Ns, z.denial(snap.records, q, m.Rcode == dns.RcodeNameError)...)
+		}
+	}
+	now := time.Now()
+	m.Answer = res.signRRsets(snap, m.Answer, now)
+	m.Ns = res.signRRsets(snap, m.Ns, now)
+}
+
+// signRRsets groups rrs into RRsets, keeping the order in which they first
+// appear, and follows each one with its signature if it belongs to a signed
+// zone.
+func (res *Resolver) signRRsets(snap *snapshot, rrs []dns.RR, now time.Time) []dns.RR {
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+	}
+	var order []rrsetKey
+	sets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range rrs {
+		k := rrsetKey{dns.CanonicalName(rr.Header().Name), rr.Header().Rrtype}
+		if _, found := sets[k]; !found {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+
+	signed := make([]dns.RR, 0, len(rrs)+len(order))
+	for _, k := range order {
+		signed = append(signed, sets[k]...)
+		z := encloser(snap.zones, k.name)
+		if z == nil || z.key == nil {
+			continue
+		}
+		sig, err := z.key.sign(sets[k], now)
+		if err != nil {
+			res.logger.Error("failed to sign RRset", "name", k.name, "type", dns.TypeToString[k.rrtype], "err", err)
+			continue
+		}
+		signed = append(signed, sig)
+	}
+	return signed
+}
+
+// denial returns the NSEC records proving that q has no answer in z
+// (RFC 4035 section 3.1.3): for a name that doesn't exist, the NSEC covering
+// it and the one covering the wildcard that could have matched it; for a
+// name without the queried type, the NSEC at the name or at the wildcard
+// that matched it. An empty non-terminal missing from the chain is proven
+// to exist by the NSEC covering it alone, since its next name lies below.
+func (z *zone) denial(records map[string]*hostRecords, q dns.Question, nxdomain bool) []dns.RR {
+	name := dns.CanonicalName(q.Name)
+	var proof []int
+	if i, found := z.findName(name); found {
+		proof = append(proof, i)
+	} else {
+		proof = append(proof, i)
+		encloser := closestEncloser(name, z.names[i], z.names[(i+1)%len(z.names)])
+		j, found := z.findName("*." + encloser)
+		if encloser != name && (nxdomain || found) {
+			proof = append(proof, j)
+		}
+	}
+
+	var nsecs []dns.RR
+	for _, i := range slices.Compact(proof) {
+		nsecs = append(nsecs, z.nsec(records, i))
+	}
+	return nsecs
+}
+
+// findName returns the position of name in the zone's NSEC chain if it is
+// there, or else the position of the name that precedes it.
+func (z *zone) findName(name string) (int, bool) {
+	i, found := slices.BinarySearchFunc(z.names, name, canonicalCompare)
+	if found {
+		return i, true
+	}
+	return (i - 1 + len(z.names)) % len(z.names), false
+}
+
+// nsec returns the NSEC record for the i-th name of the chain, listing the
+// types held there.
+func (z *zone) nsec(records map[string]*hostRecords, i int) dns.RR {
+	name := z.names[i]
+	types := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+	if host, found := records[name]; found {
+		types = append(types, host.types()...)
+	}
+	slices.Sort(types)
+	return &dns.NSEC{
+		Hdr:        rrHeader(name, dns.TypeNSEC, min(z.soa.Hdr.Ttl, z.soa.Minttl)),
+		NextDomain: z.names[(i+1)%len(z.names)],
+		TypeBitMap: slices.Compact(types),
+	}
+}
+
+// types returns the types of every record held for the host, views
+// included, possibly with repeats.
+func (host *hostRecords) types() []uint16 {
+	var types []uint16
+	if host.cname != nil {
+		types = append(types, dns.TypeCNAME)
+	}
+	addresses := slices.Concat(host.addresses, host.records)
+	for _, view := range host.views {
+		addresses = append(addresses, view.addresses...)
+	}
+	for _, rr := range addresses {
+		types = append(types, rr.Header().Rrtype)
+	}
+	return types
+}
+
+// chainNames returns the names of records in z, and the empty non-terminals
+// between them, sorted into the canonical order of its NSEC chain. The apex
+// always comes first, since it holds the SOA.
+func chainNames(z *zone, records map[string]*hostRecords, nonTerminals map[string]bool, zones map[string]*zone) []string {
+	var names []string
+	for _, name := range slices.Concat(slices.Collect(maps.Keys(records)), slices.Collect(maps.Keys(nonTerminals))) {
+		if encloser(zones, name) == z {
+			names = append(names, name)
+		}
+	}
+	slices.SortFunc(names, canonicalCompare)
+	return names
+}
+
+// closestEncloser returns the longest ancestor of name that the NSEC from
+// owner to next shows to exist: the longer of the names they share with it.
+func closestEncloser(name, owner, next string) string {
+	labels := max(dns.CompareDomainName(name, owner), dns.CompareDomainName(name, next))
+	parts := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(parts[len(parts)-labels:], "."))
+}
+
+// canonicalCompare orders two canonical names as RFC 4034 section 6.1
+// does, comparing labels from the root down.
+func canonicalCompare(a, b string) int {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
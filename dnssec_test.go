@@ -0,0 +1,197 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newSignedResolver loads a signed zone example.com holding records, with a
+// freshly generated key, and returns the resolver and the zone's DNSKEY.
+func newSignedResolver(t *testing.T, records string) (*Resolver, *dns.DNSKEY) {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keyPath, privatePath := filepath.Join(dir, "example.com.key"), filepath.Join(dir, "example.com.private")
+	if err := os.WriteFile(keyPath, []byte(key.String()+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(privatePath, []byte(key.PrivateKeyString(private)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	res, _ := newTestResolver(t, `zones:
+  - name: example.com
+    ns: ns1.example.com
+    dnssec:
+      key: "`+keyPath+`"
+      private_key: "`+privatePath+`"
+records:
+`+records)
+	if z := res.loaded().zones["example.com."]; z == nil || z.key == nil {
+		t.Fatal("signed zone wasn't loaded")
+	}
+	return res, key
+}
+
+const signedRecords = `  - hostname: www.example.com
+    ip: 192.0.2.80
+  - hostname: a.b.example.com
+    ip: 192.0.2.1
+  - hostname: mail.example.com
+    ip: 192.0.2.25
+`
+
+// askSigned sends a query for name with the DO bit set.
+func askSigned(t *testing.T, res *Resolver, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	r.SetEdns0(4096, true)
+	return exchangeWith(t, res, r)
+}
+
+// verifySections checks that every RRset in the answer and authority
+// sections of m is followed by an RRSIG that key validates, and returns the
+// NSEC records among them.
+func verifySections(t *testing.T, m *dns.Msg, key *dns.DNSKEY) []*dns.NSEC {
+	t.Helper()
+	var nsecs []*dns.NSEC
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		sets := make(map[[2]any][]dns.RR)
+		var sigs []*dns.RRSIG
+		for _, rr := range section {
+			switch rr := rr.(type) {
+			case *dns.RRSIG:
+				sigs = append(sigs, rr)
+				continue
+			case *dns.NSEC:
+				nsecs = append(nsecs, rr)
+			}
+			k := [2]any{rr.Header().Name, rr.Header().Rrtype}
+			sets[k] = append(sets[k], rr)
+		}
+		for k, set := range sets {
+			i := slices.IndexFunc(sigs, func(sig *dns.RRSIG) bool {
+				return sig.Hdr.Name == k[0] && sig.TypeCovered == k[1]
+			})
+			if i < 0 {
+				t.Errorf("%s %s is unsigned", k[0], dns.TypeToString[k[1].(uint16)])
+				continue
+			}
+			if err := sigs[i].Verify(key, set); err != nil {
+				t.Errorf("RRSIG over %s %s doesn't validate: %v", k[0], dns.TypeToString[k[1].(uint16)], err)
+			}
+			if !sigs[i].ValidityPeriod(time.Now()) {
+				t.Errorf("RRSIG over %s %s isn't valid now", k[0], dns.TypeToString[k[1].(uint16)])
+			}
+		}
+	}
+	return nsecs
+}
+
+// covers reports whether nsec proves that name doesn't exist: name sorts
+// between its owner and next name, the last NSEC wrapping round to the apex.
+func covers(nsec *dns.NSEC, name string) bool {
+	after := canonicalCompare(nsec.Hdr.Name, name) < 0
+	before := canonicalCompare(name, nsec.NextDomain) < 0
+	if canonicalCompare(nsec.NextDomain, nsec.Hdr.Name) <= 0 {
+		return after
+	}
+	return after && before
+}
+
+// TestSignedAnswer checks that positive answers and the DNSKEY itself are
+// signed with the zone's key.
+func TestSignedAnswer(t *testing.T) {
+	res, key := newSignedResolver(t, signedRecords)
+	m := askSigned(t, res, "www.example.com.", dns.TypeA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 2 {
+		t.Fatalf("www.example.com: rcode %s, answers %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	verifySections(t, m, key)
+
+	m = askSigned(t, res, "example.com.", dns.TypeDNSKEY)
+	if len(m.Answer) != 2 || m.Answer[0].(*dns.DNSKEY).PublicKey != key.PublicKey {
+		t.Fatalf("DNSKEY: answers %v", m.Answer)
+	}
+	verifySections(t, m, key)
+}
+
+// TestSignedNXDOMAIN checks that a name that doesn't exist gets an NSEC
+// covering it and one covering the wildcard at its closest encloser.
+func TestSignedNXDOMAIN(t *testing.T) {
+	res, key := newSignedResolver(t, signedRecords)
+	for name, wildcard := range map[string]string{
+		"missing.example.com.": "*.example.com.",
+		"zzz.example.com.":     "*.example.com.",
+		"c.b.example.com.":     "*.b.example.com.",
+	} {
+		m := askSigned(t, res, name, dns.TypeA)
+		if m.Rcode != dns.RcodeNameError {
+			t.Errorf("%s: rcode %s, want NXDOMAIN", name, dns.RcodeToString[m.Rcode])
+			continue
+		}
+		nsecs := verifySections(t, m, key)
+		for _, want := range []string{name, wildcard} {
+			if !slices.ContainsFunc(nsecs, func(nsec *dns.NSEC) bool { return covers(nsec, want) }) {
+				t.Errorf("%s: no NSEC among %v covers %s", name, nsecs, want)
+			}
+		}
+	}
+}
+
+// TestSignedNODATA checks that a name without the queried type, including
+// an empty non-terminal, gets the NSEC at the name, which lists its types.
+func TestSignedNODATA(t *testing.T) {
+	res, key := newSignedResolver(t, signedRecords)
+	for name, types := range map[string][]uint16{
+		"www.example.com.": {dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+		"b.example.com.":   {dns.TypeRRSIG, dns.TypeNSEC},
+	} {
+		m := askSigned(t, res, name, dns.TypeAAAA)
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+			t.Errorf("%s: rcode %s, answers %v; want NODATA", name, dns.RcodeToString[m.Rcode], m.Answer)
+			continue
+		}
+		nsecs := verifySections(t, m, key)
+		if len(nsecs) != 1 || nsecs[0].Hdr.Name != name {
+			t.Errorf("%s: NSECs %v, want one at the name", name, nsecs)
+			continue
+		}
+		if got := nsecs[0].TypeBitMap; !slices.Equal(got, types) {
+			t.Errorf("%s: NSEC types %v, want %v", name, got, types)
+		}
+	}
+}
+
+// TestDenialOfUnchainedNonTerminal checks that an empty non-terminal missing
+// from the NSEC chain is proven to exist by the NSEC leading past it to the
+// names below, with no wildcard proof that would claim it doesn't exist.
+func TestDenialOfUnchainedNonTerminal(t *testing.T) {
+	res, _ := newSignedResolver(t, signedRecords)
+	snap := res.loaded()
+	z := *snap.zones["example.com."]
+	z.names = slices.DeleteFunc(slices.Clone(z.names), func(name string) bool { return name == "b.example.com." })
+
+	proof := z.denial(snap.records, dns.Question{Name: "b.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, false)
+	if len(proof) != 1 {
+		t.Fatalf("proof %v, want one NSEC", proof)
+	}
+	nsec := proof[0].(*dns.NSEC)
+	if !covers(nsec, "b.example.com.") || !dns.IsSubDomain("b.example.com.", nsec.NextDomain) {
+		t.Errorf("proof %v doesn't lead from before b.example.com to a name below it", nsec)
+	}
+}
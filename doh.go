@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dohContentType = "application/dns-message"
+
+func (res *Resolver) newDoHServer(cfg DoHConfig) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.Path, res.handleDoH)
+	return &http.Server{Addr: cfg.Listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+}
+
+func serveDoH(server *http.Server, cfg DoHConfig) error {
+	if cfg.Cert != "" {
+		return server.ListenAndServeTLS(cfg.Cert, cfg.Key)
+	}
+	return server.ListenAndServe()
+}
+
+func (res *Resolver) handleDoH(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+
+	var wire []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		wire, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(req.URL.Query().Get("dns"), "="))
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		wire, err = io.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize+1))
+		if len(wire) > dns.MaxMsgSize {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(wire) == 0 {
+		http.Error(w, "missing or malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(wire); err != nil {
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	var m *dns.Msg
+	var status string
+	ctx, span := res.startQuerySpan(r, "doh", req.Header)
+	if res.clientAllowed(req.RemoteAddr) {
+		client, _ := remoteAddr(req.RemoteAddr)
+		m, status = res.answerQuery(ctx, r, client)
+	}
+	// HTTP has no way to leave a query unanswered, so queries dropped by
+	// the policy are refused like those from disallowed clients.
+	if m == nil || status == "dropped" {
+		m = new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		status = "refused"
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		res.logger.Error("failed to pack DNS-over-HTTPS response", "client", req.RemoteAddr, "name", questionName(r), "err", err)
+		m = new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		if packed, err = m.Pack(); err != nil {
+			http.Error(w, "failed to build response", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	w.Write(packed)
+
+	latency := time.Since(start)
+	res.logQuery(req.RemoteAddr, r, m, status, latency)
+	endQuerySpan(span, m, status, latency)
+	recordQueryMetrics(r, m, latency)
+	res.countHit(r, status, start)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// clientSubnet returns the EDNS Client Subnet option (RFC 7871) carried by
+// m, or nil.
+func clientSubnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// withClientSubnet returns r as it should be sent upstream. A query that
+// already carries a client subnet is forwarded unchanged; otherwise, when
+// cfg.Add is set, a copy is sent with a subnet option for client's network.
+func withClientSubnet(r *dns.Msg, client netip.Addr, cfg ECSConfig) *dns.Msg {
+	if !cfg.Add || !client.IsValid() || clientSubnet(r) != nil {
+		return r
+	}
+	family, bits := uint16(1), cfg.IPv4Prefix
+	if client.Is6() {
+		family, bits = 2, cfg.IPv6Prefix
+	}
+	prefix, err := client.Prefix(int(bits))
+	if err != nil {
+		return r
+	}
+
+	q := r.Copy()
+	opt := q.IsEdns0()
+	if opt == nil {
+		q.SetEdns0(maxUDPSize, false)
+		opt = q.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: bits,
+		Address:       net.IP(prefix.Addr().AsSlice()),
+	})
+	return q
+}
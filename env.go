@@ -0,0 +1,36 @@
+package main
+
+import "strings"
+
+// recordsEnv names the environment variable that, when set, supplies the
+// records in place of the backend, for containers run without a records
+// file.
+const recordsEnv = "DNS_RECORDS"
+
+// envSource reads address records from a list of hostname=ip entries
+// separated by semicolons, such as
+// "www.example.com=10.0.0.1;api.example.com=10.0.0.2". A hostname given
+// more than once gets every address listed for it. The entries are
+// validated by the loader like any other record, so a malformed one is
+// skipped with a warning naming its position.
+type envSource string
+
+func (s envSource) read() ([]DNSRecord, error) {
+	var records []DNSRecord
+	for i, entry := range strings.Split(string(s), ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		hostname, ip, _ := strings.Cut(entry, "=")
+		records = append(records, DNSRecord{
+			Hostname: strings.TrimSpace(hostname),
+			IP:       strings.TrimSpace(ip),
+			line:     i + 1,
+			source:   recordsEnv,
+		})
+	}
+	return records, nil
+}
+
+func (s envSource) String() string { return recordsEnv }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// upstreamMaxFailures is the number of consecutive failures after which
+	// an upstream is skipped for upstreamBackoff.
+	upstreamMaxFailures = 3
+	upstreamBackoff     = 30 * time.Second
+)
+
+// upstreamHealth tracks consecutive failures of each upstream so that one
+// that keeps failing is skipped for a while instead of delaying every query.
+type upstreamHealth struct {
+	mu       sync.Mutex
+	failures map[string]int
+	skipped  map[string]time.Time
+}
+
+// order returns addrs with the upstreams currently being skipped moved to
+// the end, so they are only tried once every other upstream has failed.
+func (h *upstreamHealth) order(addrs []string, now time.Time) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var healthy, skipped []string
+	for _, addr := range addrs {
+		if now.Before(h.skipped[addr]) {
+			skipped = append(skipped, addr)
+		} else {
+			healthy = append(healthy, addr)
+		}
+	}
+	return append(healthy, skipped...)
+}
+
+// failed records a failure of addr and reports whether it is now being
+// skipped.
+func (h *upstreamHealth) failed(addr string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures[addr]++
+	if h.failures[addr] < upstreamMaxFailures {
+		return false
+	}
+	h.skipped[addr] = now.Add(upstreamBackoff)
+	h.failures[addr] = 0
+	return true
+}
+
+func (h *upstreamHealth) succeeded(addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.failures, addr)
+	delete(h.skipped, addr)
+}
+
+// forwardQuery relays r to the first of addrs that answers within timeout
+// and returns its reply unchanged apart from the query ID. Truncated UDP
+// replies are retried over TCP, and if no upstream answers the client gets
+// SERVFAIL. Replies are served from the cache when it is enabled, except
+// for queries with a client subnet, whose answers may differ from one
+// network to the next. A TSIG signature on r is for this server, not the
+// upstream, so it is left off the forwarded query; the reply is signed for
+// the client when it is written.
+func (res *Resolver) forwardQuery(ctx context.Context, r *dns.Msg, addrs []string, timeout time.Duration) *dns.Msg {
+	if r.IsTsig() != nil {
+		r = r.Copy()
+		r.Extra = r.Extra[:len(r.Extra)-1]
+	}
+	cacheable := res.cache != nil && len(r.Question) == 1 && clientSubnet(r) == nil
+	if cacheable {
+		if cached := res.cache.get(r.Question[0]); cached != nil {
+			if isNegative(cached) {
+				cacheNegativeHits.Inc()
+			} else {
+				cacheHits.Inc()
+			}
+			cached.Id = r.Id
+			matchCase(cached, r.Question[0].Name)
+			markCacheHit(ctx, true)
+			return cached
+		}
+		cacheMisses.Inc()
+		markCacheHit(ctx, false)
+	}
+
+	for _, upstream := range res.upstreams.order(addrs, time.Now()) {
+		upstreamCtx, span := res.startUpstreamSpan(ctx, upstream)
+		resp, err := exchange(upstreamCtx, r, upstream, timeout)
+		endUpstreamSpan(span, err)
+		if err != nil {
+			res.logger.Warn("upstream query failed", "upstream", upstream, "err", err)
+			if !upstreamFault(err) {
+				continue
+			}
+			upstreamFailures.WithLabelValues(upstream).Inc()
+			if res.upstreams.failed(upstream, time.Now()) {
+				res.logger.Warn("skipping failing upstream", "upstream", upstream, "for", upstreamBackoff)
+			}
+			continue
+		}
+		res.upstreams.succeeded(upstream)
+
+		resp.Id = r.Id
+		if cacheable {
+			res.cache.put(r.Question[0], resp)
+		}
+		return resp
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	return m
+}
+
+// exchange sends r to upstream over UDP, retrying over TCP if the reply is
+// truncated. Each attempt is given up after timeout, or sooner if ctx is
+// done.
+func exchange(ctx context.Context, r *dns.Msg, upstream string, timeout time.Duration) (*dns.Msg, error) {
+	resp, _, err := (&dns.Client{Net: "udp", Timeout: timeout}).ExchangeContext(ctx, r, upstream)
+	if err == nil && resp.Truncated {
+		resp, _, err = (&dns.Client{Net: "tcp", Timeout: timeout}).ExchangeContext(ctx, r, upstream)
+	}
+	return resp, err
+}
+
+// upstreamFault reports whether err, returned by exchange, is the upstream's
+// doing: it couldn't be reached, didn't answer in time or cut the reply
+// short. Errors raised before the query is sent, such as one that can't be
+// packed, say nothing about the upstream and don't count against it.
+func upstreamFault(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// matchCase rewrites a cached reply, which may have been stored for a query
+// cased differently, to use name exactly as the client wrote it.
+func matchCase(m *dns.Msg, name string) {
+	if len(m.Question) == 1 {
+		m.Question[0].Name = name
+	}
+	for _, rr := range m.Answer {
+		if strings.EqualFold(rr.Header().Name, name) {
+			rr.Header().Name = name
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startUpstream serves handler on a UDP port of the loopback address for
+// the length of the test and returns its address.
+func startUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+// answerAll is an upstream that answers every A query with 198.51.100.1.
+func answerAll(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.RecursionAvailable = true
+	rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 198.51.100.1")
+	m.Answer = append(m.Answer, rr)
+	w.WriteMsg(m)
+}
+
+// TestReplyFlags checks the AA, RA and RD bits of local and forwarded
+// replies, with and without an upstream.
+func TestReplyFlags(t *testing.T) {
+	local := "records:\n  - hostname: printer.lan\n    ip: 10.0.0.5\n"
+	upstream := startUpstream(t, answerAll)
+	forwarding := "server:\n  upstream: \"" + upstream + "\"\n" + local
+
+	for _, tt := range []struct {
+		desc, yml, name string
+		rd              bool
+		aa, ra          bool
+	}{
+		{"local", local, "printer.lan.", true, true, false},
+		{"local without rd", local, "printer.lan.", false, true, false},
+		{"local with upstream", forwarding, "printer.lan.", true, true, true},
+		{"forwarded", forwarding, "example.org.", true, false, true},
+		{"forwarded without rd", forwarding, "example.org.", false, false, true},
+	} {
+		res, _ := newTestResolver(t, tt.yml)
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, dns.TypeA)
+		r.RecursionDesired = tt.rd
+		m := exchangeWith(t, res, r)
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+			t.Errorf("%s: rcode %s, %d answers", tt.desc, dns.RcodeToString[m.Rcode], len(m.Answer))
+			continue
+		}
+		if m.Authoritative != tt.aa || m.RecursionAvailable != tt.ra || m.RecursionDesired != tt.rd {
+			t.Errorf("%s: aa %v ra %v rd %v, want aa %v ra %v rd %v", tt.desc,
+				m.Authoritative, m.RecursionAvailable, m.RecursionDesired, tt.aa, tt.ra, tt.rd)
+		}
+	}
+}
+
+// TestCachedReplyMatchesCase checks that a reply served from the cache
+// echoes the name exactly as the client cased it, not as it was cased by
+// the query that filled the cache.
+func TestCachedReplyMatchesCase(t *testing.T) {
+	var queries atomic.Int32
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		answerAll(w, r)
+	})
+	res, _ := newTestResolver(t, "server:\n  upstream: \""+upstream+"\"\nrecords: []\n")
+	res.cache = newResponseCache(10, 300)
+	ask(t, res, "example.org.", dns.TypeA)
+
+	m := ask(t, res, "ExAmPlE.oRg.", dns.TypeA)
+	if queries.Load() != 1 {
+		t.Fatalf("upstream saw %d queries, want the second answered from the cache", queries.Load())
+	}
+	if m.Question[0].Name != "ExAmPlE.oRg." || len(m.Answer) != 1 || m.Answer[0].Header().Name != "ExAmPlE.oRg." {
+		t.Errorf("cached reply: question %v, answers %v", m.Question, m.Answer)
+	}
+}
+
+// TestForwardSignedQuery checks that a TSIG-signed query for a name that
+// isn't configured is forwarded without the client's signature, which the
+// upstream couldn't check, and that the reply is signed for the client.
+func TestForwardSignedQuery(t *testing.T) {
+	forwarded := make(chan *dns.Msg, 1)
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		forwarded <- r
+		answerAll(w, r)
+	})
+	res, _ := newTestResolver(t, "server:\n  upstream: \""+upstream+"\"\nrecords: []\n")
+	res.tsigAlgorithms = map[string]string{"client-key.": dns.HmacSHA256}
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	r.SetTsig("client-key.", dns.HmacSHA256, 300, time.Now().Unix())
+	m := exchangeWith(t, res, r)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Fatalf("signed query: rcode %s, answers %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	if tsig := m.IsTsig(); tsig == nil || tsig.Hdr.Name != "client-key." {
+		t.Errorf("reply isn't signed with the client's key: %v", m.Extra)
+	}
+	if got := <-forwarded; got.IsTsig() != nil {
+		t.Errorf("forwarded query kept the client's TSIG: %v", got.Extra)
+	}
+	if r.IsTsig() == nil {
+		t.Error("forwarding took the TSIG off the client's query")
+	}
+}
+
+// TestUpstreamFailures checks that only failures of the upstream itself,
+// such as timeouts, count towards skipping it, not a query that couldn't
+// be sent.
+func TestUpstreamFailures(t *testing.T) {
+	upstream := startUpstream(t, answerAll)
+	res, _ := newTestResolver(t, "records: []\n")
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	r.Extra = append(r.Extra, &dns.TXT{Hdr: dns.RR_Header{Name: "bad..name.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}})
+	for range upstreamMaxFailures {
+		if m := res.forwardQuery(context.Background(), r, []string{upstream}, time.Second); m.Rcode != dns.RcodeServerFailure {
+			t.Fatalf("unpackable query: rcode %s", dns.RcodeToString[m.Rcode])
+		}
+	}
+	if n := res.upstreams.failures[upstream]; n != 0 {
+		t.Errorf("unpackable queries counted %d failures against the upstream", n)
+	}
+	if !res.upstreams.skipped[upstream].IsZero() {
+		t.Error("unpackable queries put the upstream in backoff")
+	}
+
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	r = new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	res.forwardQuery(context.Background(), r, []string{silent.LocalAddr().String()}, 50*time.Millisecond)
+	if n := res.upstreams.failures[silent.LocalAddr().String()]; n != 1 {
+		t.Errorf("timeout counted %d failures, want 1", n)
+	}
+}
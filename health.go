@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// healthz reports whether the server is ready for queries: the records have
+// loaded, the last reload succeeded, and every DNS listener is bound. With
+// health_query set, the name must also resolve through the normal query
+// path. It answers 200 when healthy and 503 with the reason otherwise.
+func (res *Resolver) healthz(w http.ResponseWriter, req *http.Request) {
+	if reason := res.unhealthy(); reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// unhealthy returns why the server isn't ready, or "" if it is.
+func (res *Resolver) unhealthy() string {
+	switch {
+	case res.current.Load() == nil:
+		return "records not loaded"
+	case res.reloadFailed.Load():
+		return "last reload failed"
+	case !res.listening.Load():
+		return "listeners not ready"
+	}
+	if name := res.currentServerConfig().Metrics.HealthQuery; name != "" {
+		r := new(dns.Msg)
+		r.SetQuestion(dns.Fqdn(name), dns.TypeA)
+		m, _ := res.answerQuery(context.Background(), r, netip.IPv6Loopback())
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 {
+			return "health query for " + name + " failed: " + dns.RcodeToString[m.Rcode]
+		}
+	}
+	return ""
+}
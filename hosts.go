@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readHostsFile parses a file in /etc/hosts format into address records, one
+// per hostname or alias on each line. Addresses are validated later by the
+// loader like any other record.
+func readHostsFile(path string) ([]DNSRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []DNSRecord
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			continue
+		}
+		ip, _, _ := strings.Cut(fields[0], "%")
+		for _, hostname := range fields[1:] {
+			records = append(records, DNSRecord{Hostname: hostname, IP: ip, line: line, source: path})
+		}
+	}
+	return records, scanner.Err()
+}
+
+// hostsRecords reads every hosts file listed in the configuration. Relative
+// paths are resolved against the directory of the records file at path.
+// Files that can't be read are skipped.
+func (res *Resolver) hostsRecords(files []string, path string) []DNSRecord {
+	var records []DNSRecord
+	for _, file := range files {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		entries, err := readHostsFile(file)
+		if err != nil {
+			res.logger.Error("failed to read hosts file", "path", file, "err", err)
+			continue
+		}
+		records = append(records, entries...)
+	}
+	return records
+}
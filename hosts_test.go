@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// TestHostsFileMerges checks that a hosts file adds its addresses to the
+// records the YAML file gives a name instead of replacing them.
+func TestHostsFileMerges(t *testing.T) {
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(hosts, []byte("# office\n192.0.2.10 example.com www.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, _ := newTestResolver(t, "hosts_files: ["+hosts+"]\nrecords:\n  - hostname: example.com\n    type: MX\n    preference: 10\n    target: mail.example.com\n  - hostname: example.com\n    type: TXT\n    text: v=spf1 mx -all\n")
+
+	for qtype, want := range map[uint16]int{dns.TypeA: 1, dns.TypeMX: 1, dns.TypeTXT: 1} {
+		if m := ask(t, res, "example.com.", qtype); len(m.Answer) != want {
+			t.Errorf("example.com %s: %d answers, want %d", dns.TypeToString[qtype], len(m.Answer), want)
+		}
+	}
+	if m := ask(t, res, "www.example.com.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("www.example.com A: %v", m.Answer)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// includedFile is the part of an included file that is read: its records and
+// any further includes. Server settings are only taken from the main file.
+type includedFile struct {
+	Records []DNSRecord `yaml:"records"`
+	Include []string    `yaml:"include"`
+}
+
+// readIncludes reads the files included by from, and recursively the files
+// they include, returning their records in the order they should apply.
+// Relative paths are resolved against the directory of the including file.
+// stack holds the files currently being read, to catch circular includes.
+func readIncludes(from string, files []string, stack []string) ([]DNSRecord, error) {
+	var records []DNSRecord
+	for _, file := range files {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(from), file)
+		}
+		file, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(stack, file) {
+			return nil, fmt.Errorf("circular include of %s from %s", file, from)
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var inc includedFile
+		if err := yaml.Unmarshal(data, &inc); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		for i := range inc.Records {
+			inc.Records[i].source = file
+			inc.Records[i].included = true
+		}
+		records = append(records, inc.Records...)
+
+		nested, err := readIncludes(file, inc.Include, append(stack, file))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, nested...)
+	}
+	return records, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// TestIncludeOverrides checks that a later included file replaces what
+// earlier files said about a name, while names it doesn't mention keep
+// their records.
+func TestIncludeOverrides(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "prod.yml"), []byte("records:\n  - hostname: app.lan\n    ip: 10.0.1.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, _ := newTestResolver(t, "include: ["+filepath.Join(dir, "prod.yml")+"]\nrecords:\n  - hostname: app.lan\n    ip: 10.0.0.1\n  - hostname: app.lan\n    type: TXT\n    text: dev\n  - hostname: db.lan\n    ip: 10.0.0.2\n")
+
+	if m := ask(t, res, "app.lan.", dns.TypeA); len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.1.1" {
+		t.Errorf("app.lan A = %v, want only the included address", m.Answer)
+	}
+	if m := ask(t, res, "app.lan.", dns.TypeTXT); len(m.Answer) != 0 {
+		t.Errorf("app.lan TXT = %v, want it replaced by the include", m.Answer)
+	}
+	if m := ask(t, res, "db.lan.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("db.lan A = %v", m.Answer)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// setupLogging makes a text logger on stdout the default and returns the
+// level it logs at, for a resolver to change when its config is reloaded.
+func setupLogging() *slog.LevelVar {
+	level := new(slog.LevelVar)
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+	return level
+}
+
+// questionName returns the name asked about in r, for log lines.
+func questionName(r *dns.Msg) string {
+	if len(r.Question) == 0 {
+		return ""
+	}
+	return r.Question[0].Name
+}
+
+// logQuery writes one line describing the query r from the client at remote
+// ("host:port") and the reply m sent back.
+func (res *Resolver) logQuery(remote string, r, m *dns.Msg, status string, latency time.Duration) {
+	var name, qtype string
+	if len(r.Question) > 0 {
+		name = r.Question[0].Name
+		qtype = dns.TypeToString[r.Question[0].Qtype]
+	}
+	client, _, _ := net.SplitHostPort(remote)
+	res.logger.Info("query",
+		"client", client,
+		"name", name,
+		"type", qtype,
+		"status", status,
+		"rcode", dns.RcodeToString[m.Rcode],
+		"latency", latency,
+	)
+}
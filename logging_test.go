@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLogLevel checks that log_level only changes the level of the resolver
+// whose config set it, and only once that config has been accepted.
+func TestLogLevel(t *testing.T) {
+	dir := t.TempDir()
+	load := func(res *Resolver, yml string) {
+		t.Helper()
+		path := filepath.Join(dir, "dns_records.yml")
+		if err := os.WriteFile(path, []byte(yml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		res.loadRecords(path)
+	}
+	newResolver := func() (*Resolver, *slog.LevelVar) {
+		level := new(slog.LevelVar)
+		return NewResolver(slog.New(slog.DiscardHandler), WithLogLevel(level)), level
+	}
+	first, firstLevel := newResolver()
+	second, secondLevel := newResolver()
+
+	load(first, "server:\n  log_level: debug\n  multiple_questions: bogus\nrecords: []\n")
+	if firstLevel.Level() != slog.LevelInfo {
+		t.Errorf("rejected config set the level to %v", firstLevel.Level())
+	}
+
+	load(first, "server:\n  log_level: debug\nrecords: []\n")
+	load(second, "server:\n  log_level: error\nrecords: []\n")
+	if firstLevel.Level() != slog.LevelDebug || secondLevel.Level() != slog.LevelError {
+		t.Errorf("levels are %v and %v, want DEBUG and ERROR", firstLevel.Level(), secondLevel.Level())
+	}
+
+	load(second, "server:\n  log_level: loud\nrecords: []\n")
+	if secondLevel.Level() != slog.LevelError {
+		t.Errorf("invalid log_level changed the level to %v", secondLevel.Level())
+	}
+}
@@ -1,72 +1,1377 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/miekg/dns"
 	"gopkg.in/yaml.v3"
 )
 
 type DNSRecord struct {
-	Hostname string `yaml:"hostname"`
-	IP       string `yaml:"ip"`
+	Hostname string       `yaml:"hostname" json:"hostname"`
+	Aliases  stringList   `yaml:"aliases,omitempty" json:"aliases,omitempty"`
+	IP       string       `yaml:"ip,omitempty" json:"ip,omitempty"`
+	IPs      []weightedIP `yaml:"ips,omitempty" json:"ips,omitempty"`
+	Type     string       `yaml:"type,omitempty" json:"type,omitempty"`
+	Target   string       `yaml:"target,omitempty" json:"target,omitempty"`
+	TTL      *uint32      `yaml:"ttl,omitempty" json:"ttl,omitempty"`
+
+	Views map[string]stringList `yaml:"views,omitempty" json:"views,omitempty"`
+
+	Preference uint16     `yaml:"preference,omitempty" json:"preference,omitempty"`
+	Text       stringList `yaml:"text,omitempty" json:"text,omitempty"`
+	Priority   int        `yaml:"priority,omitempty" json:"priority,omitempty"`
+	Weight     int        `yaml:"weight,omitempty" json:"weight,omitempty"`
+	Port       int        `yaml:"port,omitempty" json:"port,omitempty"`
+	Flag       int        `yaml:"flag,omitempty" json:"flag,omitempty"`
+	Tag        string     `yaml:"tag,omitempty" json:"tag,omitempty"`
+	Value      string     `yaml:"value,omitempty" json:"value,omitempty"`
+
+	line   int
+	source string
+	// included is set for records read from a file named by include.
+	included bool
+	// fileIndex is the record's position in the records file, counting
+	// from 1, or 0 for a record that isn't written there.
+	fileIndex int
+}
+
+func (r *DNSRecord) UnmarshalYAML(value *yaml.Node) error {
+	type plain DNSRecord
+	if err := value.Decode((*plain)(r)); err != nil {
+		return err
+	}
+	r.line = value.Line
+	return nil
+}
+
+// stringList accepts either a single YAML string or a list of strings.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = stringList{value.Value}
+		return nil
+	}
+	return value.Decode((*[]string)(l))
+}
+
+// weightedIP is an entry in an ips list: either a plain address or an
+// address with a weight that makes it come first in proportionally more
+// answers. Unweighted addresses count as weight 1, and an address of weight
+// 0 never comes first.
+type weightedIP struct {
+	IP     string `yaml:"ip" json:"ip"`
+	Weight *int   `yaml:"weight,omitempty" json:"weight,omitempty"`
+}
+
+func (w *weightedIP) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*w = weightedIP{IP: value.Value}
+		return nil
+	}
+	type plain weightedIP
+	return value.Decode((*plain)(w))
+}
+
+func (w weightedIP) MarshalYAML() (any, error) {
+	if w.Weight == nil {
+		return w.IP, nil
+	}
+	type plain weightedIP
+	return plain(w), nil
+}
+
+func (w *weightedIP) UnmarshalJSON(data []byte) error {
+	if json.Unmarshal(data, &w.IP) == nil {
+		return nil
+	}
+	type plain weightedIP
+	return json.Unmarshal(data, (*plain)(w))
+}
+
+func (w weightedIP) MarshalJSON() ([]byte, error) {
+	if w.Weight == nil {
+		return json.Marshal(w.IP)
+	}
+	type plain weightedIP
+	return json.Marshal(plain(w))
+}
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*l = stringList{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+type ServerConfig struct {
+	Listen     string        `yaml:"listen"`
+	Net        string        `yaml:"net"`
+	DefaultTTL uint32        `yaml:"default_ttl"`
+	Upstream   stringList    `yaml:"upstream"`
+	Cache      CacheConfig   `yaml:"cache"`
+	LogLevel   string        `yaml:"log_level"`
+	Metrics    MetricsConfig `yaml:"metrics"`
+	API        APIConfig     `yaml:"api"`
+	AutoPTR    bool          `yaml:"auto_ptr"`
+	RefuseANY  bool          `yaml:"refuse_any"`
+
+	UpstreamTimeout time.Duration `yaml:"upstream_timeout"`
+
+	ShutdownGrace time.Duration   `yaml:"shutdown_grace"`
+	TLS           TLSConfig       `yaml:"tls"`
+	DoH           DoHConfig       `yaml:"doh"`
+	RateLimit     RateLimitConfig `yaml:"rate_limit"`
+
+	AllowedClients []string `yaml:"allowed_clients"`
+	Blocklist      []string `yaml:"blocklist"`
+	BlockMode      string   `yaml:"block_mode"`
+	SinkholeIP     string   `yaml:"sinkhole_ip"`
+
+	CatchAll stringList `yaml:"catch_all"`
+	ECS      ECSConfig  `yaml:"ecs"`
+
+	UnsupportedClass string      `yaml:"unsupported_class"`
+	Chaos            ChaosConfig `yaml:"chaos"`
+
+	TSIGKeys []TSIGKey `yaml:"tsig_keys"`
+
+	MinimalResponses bool `yaml:"minimal_responses"`
+	MaxAnswers       int  `yaml:"max_answers"`
+
+	MultipleQuestions string `yaml:"multiple_questions"`
+
+	RequireRecords bool `yaml:"require_records"`
+
+	// UDPSize is the largest UDP query read, and ReadBuffer and WriteBuffer
+	// size the sockets of the UDP and TCP listeners, with zero leaving the
+	// operating system's default. All three are read at startup.
+	UDPSize     int `yaml:"udp_size"`
+	ReadBuffer  int `yaml:"read_buffer"`
+	WriteBuffer int `yaml:"write_buffer"`
+
+	TTLJitter TTLJitterConfig `yaml:"ttl_jitter"`
+
+	Tracing TracingConfig `yaml:"tracing"`
+}
+
+// TTLJitterConfig lowers the TTLs of each local answer by a random share of
+// up to Percent, but never below Floor seconds, so that records cached at
+// the same moment don't all expire together.
+type TTLJitterConfig struct {
+	Percent int    `yaml:"percent"`
+	Floor   uint32 `yaml:"floor"`
+}
+
+// TLSConfig enables a DNS-over-TLS listener when Listen is set.
+type TLSConfig struct {
+	Listen string `yaml:"listen"`
+	Cert   string `yaml:"cert"`
+	Key    string `yaml:"key"`
+}
+
+// DoHConfig enables a DNS-over-HTTPS endpoint (RFC 8484) when Listen is set.
+// Without a certificate it serves plain HTTP, for use behind a TLS proxy.
+type DoHConfig struct {
+	Listen string `yaml:"listen"`
+	Path   string `yaml:"path"`
+	Cert   string `yaml:"cert"`
+	Key    string `yaml:"key"`
+}
+
+// RateLimitConfig throttles each client IP to QPS queries per second with
+// bursts of up to Burst. Queries over the limit are refused or dropped,
+// depending on Action. Rate limiting is off while QPS is zero.
+type RateLimitConfig struct {
+	QPS    float64 `yaml:"qps"`
+	Burst  int     `yaml:"burst"`
+	Action string  `yaml:"action"`
+}
+
+// ECSConfig controls EDNS Client Subnet handling when forwarding. Subnets
+// sent by clients are always passed on. With Add, queries without one get a
+// subnet built from the client address, truncated to IPv4Prefix or
+// IPv6Prefix bits. Strip removes the subnet from replies to clients.
+type ECSConfig struct {
+	Add        bool  `yaml:"add"`
+	IPv4Prefix uint8 `yaml:"ipv4_prefix"`
+	IPv6Prefix uint8 `yaml:"ipv6_prefix"`
+	Strip      bool  `yaml:"strip"`
+}
+
+// APIConfig enables the admin HTTP API for managing records at runtime when
+// Listen is set. With Persist, changes are also written back to the records
+// file so they survive a restart. Query statistics are cleared whenever the
+// records file is reloaded unless KeepStats is set.
+type APIConfig struct {
+	Listen    string `yaml:"listen"`
+	Persist   bool   `yaml:"persist"`
+	KeepStats bool   `yaml:"keep_stats"`
+}
+
+type MetricsConfig struct {
+	Listen      string `yaml:"listen"`
+	HealthQuery string `yaml:"health_query"`
+}
+
+// CacheConfig controls caching of upstream replies. NegativeTTL caps how
+// long NXDOMAIN and empty replies are kept; zero stops caching them.
+type CacheConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Size        int    `yaml:"size"`
+	NegativeTTL uint32 `yaml:"negative_ttl"`
 }
 
 type Config struct {
-	Records []DNSRecord `yaml:"records"`
+	Server  ServerConfig `yaml:"server"`
+	Records []DNSRecord  `yaml:"records"`
+	Zones   []ZoneConfig `yaml:"zones"`
+	Policy  []PolicyRule `yaml:"policy"`
+
+	Include    []string      `yaml:"include"`
+	HostsFiles []string      `yaml:"hosts_files"`
+	Backend    BackendConfig `yaml:"backend"`
+
+	// sourced holds the records read from the backend: the included files,
+	// or the rows of the SQLite table.
+	sourced []DNSRecord
+	// fileRecords is the number of records in the records file, or -1 when
+	// there is no file, as when DNS_RECORDS supplies every record.
+	fileRecords int
 }
 
-var dnsRecords map[string]string
+func defaultServerConfig() ServerConfig {
+	return ServerConfig{
+		Listen:     ":53",
+		Net:        "both",
+		DefaultTTL: 60,
+		Cache:      CacheConfig{Size: 1000, NegativeTTL: 300},
+		LogLevel:   "info",
+
+		UpstreamTimeout: 2 * time.Second,
+
+		ShutdownGrace: 5 * time.Second,
+		DoH:           DoHConfig{Path: "/dns-query"},
+		RateLimit:     RateLimitConfig{Action: "refuse"},
+		BlockMode:     "nxdomain",
+		SinkholeIP:    "0.0.0.0",
+		ECS:           ECSConfig{IPv4Prefix: 24, IPv6Prefix: 56},
+
+		UnsupportedClass: "refused",
+		Chaos:            ChaosConfig{Version: "dns-server"},
+
+		MultipleQuestions: "formerr",
+		UDPSize:           dns.MinMsgSize,
+		Tracing:           TracingConfig{ServiceName: "dns-server", SampleRatio: 1},
+	}
+}
+
+type hostRecords struct {
+	addresses []dns.RR
+	weights   map[dns.RR]int
+	views     []addressView
+	cname     *dns.CNAME
+	records   []dns.RR
+	next      atomic.Uint64
+}
+
+// addressView holds the addresses served instead of the defaults to clients
+// within prefix.
+type addressView struct {
+	prefix    netip.Prefix
+	addresses []dns.RR
+}
 
-func loadRecords() {
-	data, err := os.ReadFile("dns_records.yml")
+var errCNAMEConflict = errors.New("CNAME cannot coexist with other records for the same name")
+
+func (host *hostRecords) add(rr dns.RR) error {
+	if host.cname != nil {
+		return errCNAMEConflict
+	}
+	switch rr := rr.(type) {
+	case *dns.CNAME:
+		if len(host.addresses) > 0 || len(host.views) > 0 || len(host.records) > 0 {
+			return errCNAMEConflict
+		}
+		host.cname = rr
+	case *dns.A, *dns.AAAA:
+		host.addresses = append(host.addresses, rr)
+	default:
+		host.records = append(host.records, rr)
+	}
+	return nil
+}
+
+// size returns the number of records held for the host.
+func (host *hostRecords) size() int {
+	n := len(host.addresses) + len(host.records)
+	if host.cname != nil {
+		n++
+	}
+	for _, view := range host.views {
+		n += len(view.addresses)
+	}
+	return n
+}
+
+// setWeights records the weight of each address in rrs.
+func (host *hostRecords) setWeights(rrs []dns.RR, weights []int) {
+	if host.weights == nil {
+		host.weights = make(map[dns.RR]int)
+	}
+	for i, rr := range rrs {
+		host.weights[rr] = weights[i]
+	}
+}
+
+// first returns the position in addresses of the address that should lead
+// the n-th answer. Without weights that simply cycles through them; with
+// weights each address leads a share of answers proportional to its weight,
+// and those of weight 0 never do unless all of them are.
+func (host *hostRecords) first(addresses []dns.RR, n uint64) uint64 {
+	if host.weights == nil || len(addresses) < 2 {
+		return n
+	}
+	weight := func(rr dns.RR) uint64 {
+		if w, found := host.weights[rr]; found {
+			return uint64(w)
+		}
+		return 1
+	}
+	var total uint64
+	for _, rr := range addresses {
+		total += weight(rr)
+	}
+	if total == 0 {
+		return n
+	}
+	pos := n % total
+	for i, rr := range addresses {
+		if pos < weight(rr) {
+			return uint64(i)
+		}
+		pos -= weight(rr)
+	}
+	return 0
+}
+
+// addView merges view into the host's views, keeping the most specific
+// prefixes first.
+func (host *hostRecords) addView(view addressView) error {
+	if host.cname != nil {
+		return errCNAMEConflict
+	}
+	for i := range host.views {
+		if host.views[i].prefix == view.prefix {
+			host.views[i].addresses = slices.Concat(host.views[i].addresses, view.addresses)
+			return nil
+		}
+	}
+	host.views = append(host.views, view)
+	slices.SortFunc(host.views, func(a, b addressView) int {
+		if c := cmp.Compare(b.prefix.Bits(), a.prefix.Bits()); c != 0 {
+			return c
+		}
+		return a.prefix.Addr().Compare(b.prefix.Addr())
+	})
+	return nil
+}
+
+// addressesFor returns the addresses to serve to client: those of the most
+// specific view containing it, or the defaults when no view does.
+func (host *hostRecords) addressesFor(client netip.Addr) []dns.RR {
+	for _, view := range host.views {
+		if view.prefix.Contains(client) {
+			return view.addresses
+		}
+	}
+	return host.addresses
+}
+
+const defaultRecordsFile = "dns_records.yml"
+
+// maxUDPSize is the UDP payload size advertised to EDNS0 clients, following
+// the DNS Flag Day 2020 recommendation to avoid IP fragmentation.
+const maxUDPSize = 1232
+
+// snapshot is everything built from one load of the records. It is never
+// modified once published, so queries read it without locking and a reload
+// simply swaps in a new one.
+type snapshot struct {
+	path           string
+	config         Config
+	records        map[string]*hostRecords
+	allowedClients []netip.Prefix
+	blocklist      *blocklist
+	policy         []*policyRule
+	zones          map[string]*zone
+	authority      map[string]bool
+	catchAll       []net.IP
+
+	// nonTerminals holds every name that has no records of its own but
+	// names below it do, such as b.example.com when only a.b.example.com
+	// is configured.
+	nonTerminals map[string]bool
+}
+
+var emptySnapshot = &snapshot{config: Config{Server: defaultServerConfig()}}
+
+// loaded returns the snapshot currently being served.
+func (res *Resolver) loaded() *snapshot {
+	if s := res.current.Load(); s != nil {
+		return s
+	}
+	return emptySnapshot
+}
+
+// loadRecords reads the records file at path and makes it the live
+// configuration. On failure the previous records stay in place, and the
+// error, which has already been logged, is returned.
+func (res *Resolver) loadRecords(path string) error {
+	// A reload must not land between an edit reading the live records and
+	// applying its change to them, or the edit would put back what the
+	// reload replaced.
+	res.editMu.Lock()
+	defer res.editMu.Unlock()
+
+	// With the records in DNS_RECORDS the file is optional, and only adds
+	// server settings.
+	data, err := os.ReadFile(path)
+	_, fromEnv := os.LookupEnv(recordsEnv)
+	noFile := fromEnv && errors.Is(err, fs.ErrNotExist)
+	if noFile {
+		data, err = nil, nil
+	}
 	if err != nil {
-		fmt.Println("Error reading YAML:", err)
-		return
+		res.logger.Error("failed to read records", "path", path, "err", err)
+		res.reloadFailed.Store(true)
+		return err
 	}
 
-	var config Config
+	config := Config{Server: defaultServerConfig()}
 	err = yaml.Unmarshal(data, &config)
 	if err != nil {
-		fmt.Println("Error parsing YAML:", err)
+		res.logger.Error("failed to parse records", "path", path, "err", err)
+		res.reloadFailed.Store(true)
+		return err
+	}
+	config.fileRecords = len(config.Records)
+	if noFile {
+		config.fileRecords = -1
+	}
+	for i := range config.Records {
+		config.Records[i].fileIndex = i + 1
+	}
+	source, err := newRecordSource(config, path)
+	if err == nil {
+		config.sourced, err = source.read()
+	}
+	if err != nil {
+		res.logger.Error("failed to read records from backend", "path", path, "err", err)
+		res.reloadFailed.Store(true)
+		return err
+	}
+	if res.current.Load() == nil {
+		res.logger.Info("reading records", "path", path, "source", source)
+	}
+	previous := res.loaded()
+	res.applyConfig(config, path)
+	applied := res.loaded() != previous
+	res.reloadFailed.Store(!applied)
+	if !applied {
+		return errConfigRejected
+	}
+	if !config.Server.API.KeepStats {
+		res.stats.reset()
+	}
+	return nil
+}
+
+var errConfigRejected = errors.New("invalid server settings")
+
+// requireRecords returns an error if require_records is set and the server
+// has nothing to answer with: no records loaded and no upstream to forward
+// misses to.
+func (res *Resolver) requireRecords() error {
+	snap := res.loaded()
+	if cfg := snap.config.Server; cfg.RequireRecords && len(snap.records) == 0 && len(cfg.Upstream) == 0 {
+		return errors.New("require_records is set but no records loaded and no upstream is configured")
+	}
+	return nil
+}
+
+// applyConfig validates config and makes it the live configuration. path is
+// only used for logging. If the server settings are invalid the previous
+// configuration stays in place.
+func (res *Resolver) applyConfig(config Config, path string) {
+	var level slog.Level
+	levelErr := level.UnmarshalText([]byte(config.Server.LogLevel))
+	if levelErr != nil {
+		res.logger.Error("invalid log_level", "value", config.Server.LogLevel, "err", levelErr)
+	}
+
+	allowed, err := parsePrefixes(config.Server.AllowedClients)
+	if err != nil {
+		res.logger.Error("invalid allowed_clients", "path", path, "err", err)
+		return
+	}
+	blocked, err := newBlocklist(config.Server)
+	if err != nil {
+		res.logger.Error("invalid blocklist", "path", path, "err", err)
+		return
+	}
+	policy, err := parsePolicy(config.Policy)
+	if err != nil {
+		res.logger.Error("invalid policy", "path", path, "err", err)
+		return
+	}
+	catchAll, err := parseCatchAll(config.Server.CatchAll)
+	if err != nil {
+		res.logger.Error("invalid catch_all", "path", path, "err", err)
+		return
+	}
+	if ecs := config.Server.ECS; ecs.IPv4Prefix > 32 || ecs.IPv6Prefix > 128 {
+		res.logger.Error("invalid ecs prefix length", "path", path, "ipv4_prefix", ecs.IPv4Prefix, "ipv6_prefix", ecs.IPv6Prefix)
+		return
+	}
+	if mode := config.Server.MultipleQuestions; mode != "formerr" && mode != "first" {
+		res.logger.Error("invalid multiple_questions", "path", path, "value", mode)
+		return
+	}
+	if config.Server.MaxAnswers < 0 {
+		res.logger.Error("invalid max_answers", "path", path, "value", config.Server.MaxAnswers)
+		return
+	}
+	if size := config.Server.UDPSize; size < dns.MinMsgSize || size > dns.MaxMsgSize {
+		res.logger.Error("invalid udp_size", "path", path, "value", size)
+		return
+	}
+	if config.Server.ReadBuffer < 0 || config.Server.WriteBuffer < 0 {
+		res.logger.Error("invalid socket buffer size", "path", path, "read_buffer", config.Server.ReadBuffer, "write_buffer", config.Server.WriteBuffer)
+		return
+	}
+	if jitter := config.Server.TTLJitter; jitter.Percent < 0 || jitter.Percent > 100 {
+		res.logger.Error("invalid ttl_jitter percent", "path", path, "value", jitter.Percent)
+		return
+	}
+	if ratio := config.Server.Tracing.SampleRatio; ratio < 0 || ratio > 1 {
+		res.logger.Error("invalid tracing sample_ratio", "path", path, "value", ratio)
+		return
+	}
+	if config.Server.UpstreamTimeout <= 0 {
+		res.logger.Error("invalid upstream_timeout", "path", path, "value", config.Server.UpstreamTimeout)
+		return
+	}
+	if _, err := classRcode(config.Server.UnsupportedClass); err != nil {
+		res.logger.Error("invalid unsupported_class", "path", path, "err", err)
 		return
 	}
+	// The settings are accepted, so their log level applies from here on,
+	// including to the records loaded below.
+	if res.level != nil && levelErr == nil {
+		res.level.Set(level)
+	}
+
+	records := make(map[string]*hostRecords)
+	sources := make(map[string]string)
+	count, skipped := 0, 0
+	for _, record := range expandAliases(slices.Concat(config.Records, config.sourced, res.hostsRecords(config.HostsFiles, path))) {
+		name, err := ownerName(record.Hostname)
+		source := record.source
+		if source == "" {
+			source = path
+		}
+		ttl := config.Server.DefaultTTL
+		if record.TTL != nil {
+			ttl = *record.TTL
+		}
+
+		var rrs []dns.RR
+		if err == nil {
+			rrs, err = parseRecord(record, name, ttl)
+		}
+		var views []addressView
+		if err == nil {
+			views, err = parseViews(record, name, ttl)
+		}
+		// A name defined again in a later included file replaces what
+		// earlier YAML files said about it. Hosts files, DNS_RECORDS and
+		// SQLite rows add to a name's records instead.
+		host, ok := records[name]
+		if !ok || (record.included && sources[name] != source) {
+			host = &hostRecords{}
+		}
+		for _, rr := range rrs {
+			if err != nil {
+				break
+			}
+			err = host.add(rr)
+		}
+		if weights := ipWeights(record); err == nil && weights != nil {
+			host.setWeights(rrs, weights)
+		}
+		for _, view := range views {
+			if err != nil {
+				break
+			}
+			err = host.addView(view)
+			rrs = append(rrs, view.addresses...)
+		}
+		if err != nil {
+			res.logger.Warn("skipping invalid record", "path", source, "line", record.line, "hostname", record.Hostname, "err", err)
+			skipped++
+			continue
+		}
+
+		if previous, ok := records[name]; ok && previous != host {
+			count -= previous.size()
+		}
+		records[name] = host
+		sources[name] = source
+		count += len(rrs)
+		if name != dns.CanonicalName(record.Hostname) {
+			res.logger.Info("loaded internationalized hostname", "hostname", record.Hostname, "ascii", name)
+		}
+		for _, rr := range rrs {
+			res.logger.Debug("loaded record",
+				"hostname", record.Hostname,
+				"type", dns.TypeToString[rr.Header().Rrtype],
+				"value", strings.TrimPrefix(rr.String(), rr.Header().String()),
+				"ttl", ttl,
+			)
+		}
+	}
+
+	previousZones := res.loaded().zones
+	zones := make(map[string]*zone)
+	for _, zc := range config.Zones {
+		z, err := parseZone(zc, config.Server.DefaultTTL, previousZones[dns.CanonicalName(zc.Name)])
+		if err == nil && zc.DNSSEC != (DNSSECConfig{}) {
+			z.key, err = loadZoneKey(zc.DNSSEC, z.soa, path)
+		}
+		if err == nil {
+			host, ok := records[z.soa.Hdr.Name]
+			if !ok {
+				host = &hostRecords{}
+			}
+			if err = host.add(z.soa); err == nil && z.key != nil {
+				err = host.add(z.key.dnskey)
+			}
+			if err == nil {
+				records[z.soa.Hdr.Name] = host
+			}
+		}
+		if err != nil {
+			res.logger.Warn("skipping invalid zone", "zone", zc.Name, "err", err)
+			continue
+		}
+		zones[z.soa.Hdr.Name] = z
+		res.logger.Debug("loaded zone", "zone", z.soa.Hdr.Name, "serial", z.soa.Serial)
+	}
+
+	if config.Server.AutoPTR {
+		count += addReversePointers(records)
+	}
+	authority := authorityNames(zones, records)
+	nonTerminals := emptyNonTerminals(records)
+	res.seedRotation(records)
+	for _, z := range zones {
+		if z.key != nil {
+			z.names = chainNames(z, records, nonTerminals, zones)
+		}
+	}
+
+	res.current.Store(&snapshot{
+		path:           path,
+		config:         config,
+		records:        records,
+		allowedClients: allowed,
+		blocklist:      blocked,
+		policy:         policy,
+		zones:          zones,
+		authority:      authority,
+		catchAll:       catchAll,
+		nonTerminals:   nonTerminals,
+	})
+	res.logger.Info("records loaded", "count", count, "skipped", skipped, "zones", len(zones), "path", path)
+}
+
+func (res *Resolver) currentConfig() Config {
+	return res.loaded().config
+}
+
+func (res *Resolver) currentServerConfig() ServerConfig {
+	return res.loaded().config.Server
+}
+
+// lookupHost finds the records for name, falling back to the most specific
+// wildcard that covers it when there is no exact match. Names are matched
+// case-insensitively, as DNS requires. It returns nil if nothing matches.
+func (res *Resolver) lookupHost(name string) (host *hostRecords, wildcard bool) {
+	owner, host := res.matchHost(name)
+	return host, host != nil && owner != dns.CanonicalName(name)
+}
+
+// matchHost is lookupHost, returning the name the matched records are
+// stored under: name itself in canonical form, or the wildcard. Only the
+// wildcard below the closest name that exists, with records or names beneath
+// it, can match (RFC 4592), so *.example.com doesn't answer for
+// x.dev.example.com once dev.example.com exists, nor for an empty
+// non-terminal.
+func (res *Resolver) matchHost(name string) (string, *hostRecords) {
+	name = dns.CanonicalName(name)
+	snap := res.loaded()
+	if host, found := snap.records[name]; found {
+		return name, host
+	}
+	if snap.nonTerminals[name] {
+		return name, nil
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if _, found := snap.records[name[off:]]; !found && !snap.nonTerminals[name[off:]] {
+			continue
+		}
+		if host, found := snap.records["*."+name[off:]]; found {
+			return "*." + name[off:], host
+		}
+		break
+	}
+	return name, nil
+}
+
+// emptyNonTerminals returns the names above the names in records that hold
+// no records themselves.
+func emptyNonTerminals(records map[string]*hostRecords) map[string]bool {
+	names := make(map[string]bool)
+	for name := range records {
+		for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+			if _, found := records[name[off:]]; !found {
+				names[name[off:]] = true
+			}
+		}
+	}
+	return names
+}
 
-	dnsRecords = make(map[string]string)
-	for _, record := range config.Records {
-		dnsRecords[record.Hostname+"."] = record.IP
-		fmt.Printf("Loaded: %s -> %s\n", record.Hostname, record.IP)
+// emptyNonTerminal reports whether name is an empty non-terminal inside a
+// domain this server is authoritative for. Such a name exists, so it gets
+// an empty answer rather than NXDOMAIN (RFC 8020), which would tell
+// resolvers minimizing their queries that the names below it don't exist
+// either.
+func (res *Resolver) emptyNonTerminal(name string) bool {
+	name = dns.CanonicalName(name)
+	return res.loaded().nonTerminals[name] && res.authoritative(name)
+}
+
+// withOwner returns copies of rrs owned by name, used to answer with the
+// queried name rather than the wildcard that matched it or the lowercased
+// name it was stored under.
+func withOwner(rrs []dns.RR, name string) []dns.RR {
+	renamed := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		renamed[i] = dns.Copy(rr)
+		renamed[i].Header().Name = name
+	}
+	return renamed
+}
+
+// rotate returns rrs shifted left by n positions so that successive queries
+// spread load across every address configured for a name.
+func rotate(rrs []dns.RR, n uint64) []dns.RR {
+	if len(rrs) < 2 {
+		return rrs
 	}
+	k := int(n % uint64(len(rrs)))
+	return append(append([]dns.RR{}, rrs[k:]...), rrs[:k]...)
 }
 
-func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
+func filterType(rrs []dns.RR, qtype uint16) []dns.RR {
+	var matched []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype {
+			matched = append(matched, rr)
+		}
+	}
+	return matched
+}
+
+func (host *hostRecords) answers(qtype uint16, client netip.Addr) []dns.RR {
+	addresses := host.addressesFor(client)
+	if qtype != dns.TypeANY {
+		addresses = filterType(addresses, qtype)
+	}
+	answers := rotate(addresses, host.first(addresses, host.next.Add(1)-1))
+	if qtype == dns.TypeANY {
+		return append(answers, host.records...)
+	}
+	return append(answers, filterType(host.records, qtype)...)
+}
+
+// zoneNameservers returns the NS records of the closest name at or above
+// name that has any.
+func (res *Resolver) zoneNameservers(name string) []dns.RR {
+	name = dns.CanonicalName(name)
+	records := res.loaded().records
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if host, found := records[name[off:]]; found {
+			if ns := filterType(host.records, dns.TypeNS); len(ns) > 0 {
+				return ns
+			}
+		}
+	}
+	return nil
+}
+
+// addAuthority fills in the authority section of a positive answer to q with
+// the zone's nameservers, and the additional section with glue addresses for
+// any of those nameservers that are configured locally.
+func (res *Resolver) addAuthority(m *dns.Msg, q dns.Question) {
+	nameservers := filterType(m.Answer, dns.TypeNS)
+	if len(nameservers) == 0 {
+		m.Ns = append(m.Ns, res.zoneNameservers(q.Name)...)
+	}
+	m.Extra = append(m.Extra, res.glue(append(nameservers, m.Ns...))...)
+}
+
+// glue returns the addresses configured locally for the targets of the NS
+// records in nameservers.
+func (res *Resolver) glue(nameservers []dns.RR) []dns.RR {
+	var glue []dns.RR
+	for _, rr := range nameservers {
+		if ns, ok := rr.(*dns.NS); ok {
+			if host, wildcard := res.lookupHost(ns.Ns); host != nil && !wildcard {
+				glue = append(glue, host.addresses...)
+			}
+		}
+	}
+	return glue
+}
+
+// resolveQuestion answers q from the local records, following CNAMEs whose
+// targets are also configured here, with addresses chosen for client. The
+// boolean reports whether q.Name exists.
+func (res *Resolver) resolveQuestion(q dns.Question, client netip.Addr) ([]dns.RR, bool) {
+	var answers []dns.RR
+	seen := make(map[string]bool)
+	name := q.Name
+	for {
+		host, wildcard := res.lookupHost(name)
+		if host == nil {
+			return answers, len(answers) > 0
+		}
+
+		var rrs []dns.RR
+		if host.cname != nil {
+			rrs = []dns.RR{host.cname}
+		} else {
+			rrs = host.answers(q.Qtype, client)
+		}
+		// Answers carry the name exactly as the client wrote it, since
+		// resolvers using 0x20 randomization reject a reply whose casing
+		// differs from their query.
+		if wildcard || (len(rrs) > 0 && rrs[0].Header().Name != name) {
+			rrs = withOwner(rrs, name)
+		}
+		answers = append(answers, rrs...)
+		if host.cname == nil || q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+			return answers, true
+		}
+
+		seen[dns.CanonicalName(name)] = true
+		name = host.cname.Target
+		if seen[dns.CanonicalName(name)] {
+			res.logger.Warn("CNAME loop detected", "name", q.Name)
+			return answers, true
+		}
+	}
+}
+
+// answerQuery builds the reply to r from client independently of the
+// transport it arrived on, and reports whether it matched locally, was
+// forwarded, or matched nothing. ctx carries the query's trace span on to
+// the upstream when the query is forwarded.
+func (res *Resolver) answerQuery(ctx context.Context, r *dns.Msg, client netip.Addr) (*dns.Msg, string) {
 	m := new(dns.Msg)
 	m.SetReply(r)
 
+	// Hardly any server answers more than one question per message, so
+	// such messages get FORMERR, or with multiple_questions: first, only
+	// their first question is answered.
+	if len(r.Question) != 1 {
+		if len(r.Question) == 0 || res.currentServerConfig().MultipleQuestions != "first" {
+			m.Rcode = dns.RcodeFormatError
+			res.setEdns0(m, r)
+			return m, "formerr"
+		}
+		first := r.Copy()
+		first.Question = r.Question[:1]
+		r = first
+	}
+
+	status := "matched"
 	for _, q := range r.Question {
-		if ip, found := dnsRecords[q.Name]; found {
-			rr := &dns.A{
-				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-				A:   net.ParseIP(ip),
+		if q.Qclass != dns.ClassINET {
+			if answers, found := chaosAnswers(q, res.currentServerConfig().Chaos); found {
+				m.Answer = append(m.Answer, answers...)
+				status = "chaos"
+				continue
 			}
-			m.Answer = append(m.Answer, rr)
+			m.Rcode, _ = classRcode(res.currentServerConfig().UnsupportedClass)
+			status = "refused"
+			break
+		}
+		if q.Qtype == dns.TypeANY && res.currentServerConfig().RefuseANY {
+			m.Rcode = dns.RcodeRefused
+			status = "refused"
+			break
+		}
+		rule := res.matchPolicy(q.Name)
+		if rule != nil {
+			policyHits.WithLabelValues(rule.name, rule.action).Inc()
+			res.logger.Info("policy rule matched", "rule", rule.name, "action", rule.action, "name", q.Name, "client", client)
+			if s := rule.apply(m, q, res.currentServerConfig().DefaultTTL); s != "" {
+				status = s
+				if s == "dropped" {
+					break
+				}
+				continue
+			}
+		}
+		if bl := res.currentBlocklist(); rule == nil && bl != nil && bl.blocks(q.Name) {
+			blockedTotal.Inc()
+			status = "blocked"
+			if bl.sinkhole == nil {
+				m.Rcode = dns.RcodeNameError
+				continue
+			}
+			m.Answer = append(m.Answer, bl.answer(q)...)
+			continue
+		}
+
+		if nameservers := res.delegation(q); nameservers != nil {
+			m.Ns = append(m.Ns, nameservers...)
+			m.Extra = append(m.Extra, res.glue(nameservers)...)
+			status = "referral"
+			continue
+		}
+
+		answers, found := res.resolveQuestion(q, client)
+		if !found && res.emptyNonTerminal(q.Name) {
+			continue
+		}
+		if !found {
+			if cfg := res.currentServerConfig(); len(cfg.Upstream) > 0 && res.enclosingZone(q.Name) == nil {
+				m = res.forwardQuery(ctx, withClientSubnet(r, client, cfg.ECS), cfg.Upstream, cfg.UpstreamTimeout)
+				status = "forwarded"
+				break
+			}
+			if catchAll := res.loaded().catchAll; len(catchAll) > 0 {
+				m.Answer = append(m.Answer, catchAllAnswers(q, catchAll, res.currentServerConfig().DefaultTTL)...)
+				status = "catch-all"
+				continue
+			}
+			if !res.authoritative(q.Name) {
+				m.Rcode = dns.RcodeRefused
+				status = "refused"
+				break
+			}
+			m.Rcode = dns.RcodeNameError
+			status = "unmatched"
+			continue
+		}
+		m.Answer = append(m.Answer, answers...)
+	}
+
+	if len(r.Question) == 1 && (status == "matched" || status == "unmatched") {
+		if len(m.Answer) > 0 {
+			res.addAuthority(m, r.Question[0])
+		} else if z := res.enclosingZone(r.Question[0].Name); z != nil {
+			m.Ns = append(m.Ns, negativeSOA(z.soa))
 		}
 	}
 
-	w.WriteMsg(m)
+	// Forwarded replies come from the upstream's point of view; restate
+	// the flags from ours. Referrals point elsewhere for the answer, and
+	// recursion is only available through forwarding.
+	m.Authoritative = status != "forwarded" && status != "refused" && status != "referral"
+	m.RecursionDesired = r.RecursionDesired
+	m.RecursionAvailable = len(res.currentServerConfig().Upstream) > 0
+	if status != "forwarded" {
+		res.jitterTTLs(m, res.currentServerConfig().TTLJitter)
+	}
+	if res.currentServerConfig().MinimalResponses && status != "referral" {
+		minimize(m)
+	}
+	if opt := r.IsEdns0(); opt != nil && opt.Do() && len(r.Question) == 1 && (status == "matched" || status == "unmatched" || status == "catch-all") {
+		res.signResponse(m, r.Question[0])
+	}
+	res.setEdns0(m, r)
+	return m, status
+}
+
+// setEdns0 replaces any OPT record in m, such as one relayed from the
+// upstream, with our own when the query r used EDNS0. A client subnet in the
+// upstream's reply is kept if r sent one, unless ECS stripping is on.
+func (res *Resolver) setEdns0(m, r *dns.Msg) {
+	subnet := clientSubnet(m)
+	extra := m.Extra[:0:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(maxUDPSize, opt.Do())
+		if subnet != nil && clientSubnet(r) != nil && !res.currentServerConfig().ECS.Strip {
+			reply := m.IsEdns0()
+			reply.Option = append(reply.Option, subnet)
+		}
+	}
+}
+
+// jitterTTLs lowers every TTL in m by the same random share of up to
+// cfg.Percent, which keeps the records of an RRset agreeing. Records are
+// copied before they change, since m shares them with the loaded records.
+// TTLs already at or below cfg.Floor are left alone.
+func (res *Resolver) jitterTTLs(m *dns.Msg, cfg TTLJitterConfig) {
+	if cfg.Percent == 0 {
+		return
+	}
+	res.randMu.Lock()
+	share := res.rand.Float64() * float64(cfg.Percent) / 100
+	res.randMu.Unlock()
+	for _, section := range []*[]dns.RR{&m.Answer, &m.Ns, &m.Extra} {
+		for i, rr := range *section {
+			ttl := rr.Header().Ttl
+			if rr.Header().Rrtype == dns.TypeOPT || ttl <= cfg.Floor {
+				continue
+			}
+			if jittered := max(ttl-uint32(float64(ttl)*share), cfg.Floor); jittered != ttl {
+				(*section)[i] = dns.Copy(rr)
+				(*section)[i].Header().Ttl = jittered
+			}
+		}
+	}
+}
+
+// minimize drops the additional section of m, and the authority section too
+// when m has answers. Negative answers keep their SOA so they can still be
+// cached.
+func minimize(m *dns.Msg) {
+	if len(m.Answer) > 0 {
+		m.Ns = nil
+	}
+	m.Extra = nil
+}
+
+// limitAnswers trims the answer section of m to max records, setting TC so
+// the client can retry over TCP for the rest. A max of zero means no limit.
+func limitAnswers(m *dns.Msg, max int) {
+	if max > 0 && len(m.Answer) > max {
+		m.Answer = m.Answer[:max]
+		m.Truncated = true
+	}
+}
+
+// udpSize returns the largest UDP response r's sender accepts: its EDNS0
+// buffer size capped at maxUDPSize, or 512 bytes without EDNS0.
+func udpSize(r *dns.Msg) int {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+	return int(min(max(opt.UDPSize(), dns.MinMsgSize), maxUDPSize))
+}
+
+func (res *Resolver) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
+	defer func() {
+		if p := recover(); p != nil {
+			res.logger.Error("panic while answering query", "client", w.RemoteAddr().String(), "name", questionName(r), "panic", p)
+			res.writeServerFailure(w, r)
+		}
+	}()
+	if !res.clientAllowed(w.RemoteAddr().String()) {
+		res.logger.Debug("refused query from disallowed client", "client", w.RemoteAddr().String())
+		res.refuse(w, r)
+		return
+	}
+	if res.limiter != nil {
+		client, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		if !res.limiter.allow(client) {
+			rateLimitedTotal.Inc()
+			res.logger.Debug("rate limited query", "client", client)
+			if res.limiter.refuse {
+				res.refuse(w, r)
+			}
+			return
+		}
+	}
+	if tsigErr := res.tsigError(w, r); tsigErr != dns.RcodeSuccess {
+		res.writeTSIGError(w, r, tsigErr)
+		return
+	}
+	if len(r.Question) == 1 && r.Question[0].Qtype == dns.TypeAXFR {
+		res.serveTransfer(w, r)
+		return
+	}
+	if r.Opcode == dns.OpcodeUpdate {
+		res.serveUpdate(w, r)
+		return
+	}
+
+	client, _ := remoteAddr(w.RemoteAddr().String())
+	ctx, span := res.startQuerySpan(r, w.RemoteAddr().Network(), nil)
+	m, status := res.answerQuery(ctx, r, client)
+	if status == "dropped" {
+		res.logQuery(w.RemoteAddr().String(), r, m, status, time.Since(start))
+		endQuerySpan(span, m, status, time.Since(start))
+		return
+	}
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		limitAnswers(m, res.currentServerConfig().MaxAnswers)
+		m.Truncate(udpSize(r))
+	}
+	res.signReply(w, m, r)
+
+	if err := w.WriteMsg(m); err != nil {
+		res.logger.Error("failed to write response", "client", w.RemoteAddr().String(), "name", questionName(r), "err", err)
+		m = res.writeServerFailure(w, r)
+	}
+	latency := time.Since(start)
+	res.logQuery(w.RemoteAddr().String(), r, m, status, latency)
+	endQuerySpan(span, m, status, latency)
+	recordQueryMetrics(r, m, latency)
+	res.countHit(r, status, start)
+}
+
+// writeServerFailure answers r with SERVFAIL after the real response could
+// not be built or sent, and returns the reply it tried to send.
+func (res *Resolver) writeServerFailure(w dns.ResponseWriter, r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	res.signReply(w, m, r)
+	if err := w.WriteMsg(m); err != nil {
+		res.logger.Debug("failed to write SERVFAIL response", "client", w.RemoteAddr().String(), "err", err)
+	}
+	return m
 }
 
 func main() {
-	loadRecords()
+	level := setupLogging()
+
+	defaultPath := defaultRecordsFile
+	if env := os.Getenv("DNS_CONFIG"); env != "" {
+		defaultPath = env
+	}
+	configPath := flag.String("config", defaultPath, "path to the records file (overrides DNS_CONFIG)")
+	flag.Parse()
+	_, fromEnv := os.LookupEnv(recordsEnv)
+	if _, err := os.Stat(*configPath); err != nil && !fromEnv {
+		slog.Error("config file not found", "path", *configPath, "err", err)
+		os.Exit(1)
+	}
+
+	res := NewResolver(slog.Default(), WithLogLevel(level))
+	err := res.loadRecords(*configPath)
+	if err == nil {
+		err = res.requireRecords()
+	}
+	if err != nil {
+		slog.Error("refusing to start", "path", *configPath, "err", err)
+		os.Exit(1)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	if err := res.Run(*configPath, stop); err != nil {
+		if hint := bindHint(err); hint != "" {
+			slog.Error("failed to bind listener", "err", err, "hint", hint)
+			os.Exit(exitBindFailed)
+		}
+		slog.Error("failed to start server", "err", err)
+		os.Exit(1)
+	}
+}
 
-	dns.HandleFunc(".", handleDNSRequest)
-	server := &dns.Server{Addr: ":53", Net: "udp"}
+// exitBindFailed is the exit status when a listener can't bind its
+// address, so supervisors can tell it apart from other startup failures,
+// which exit with 1.
+const exitBindFailed = 3
 
-	fmt.Println("Starting DNS server on port 53...")
-	err := server.ListenAndServe()
+// bindHint suggests a fix for err if it is a failure to bind a listening
+// socket, and returns "" otherwise.
+func bindHint(err error) string {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "listen" {
+		return ""
+	}
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return "ports below 1024 need root or the CAP_NET_BIND_SERVICE capability (setcap cap_net_bind_service=+ep on the binary), or listen on a higher port such as :8053"
+	case errors.Is(err, syscall.EADDRINUSE):
+		return "another process is already listening on this address, often systemd-resolved on port 53; stop it or listen elsewhere"
+	default:
+		return "check that the listen address is valid and assigned to this host"
+	}
+}
+
+// Run starts every listener, API and watcher the loaded configuration asks
+// for, reloading the records from path as it changes, and serves until a
+// signal arrives on stop. Settings that can't change on reload, such as the
+// listen addresses, are taken from the configuration loaded at this point.
+func (res *Resolver) Run(path string, stop <-chan os.Signal) error {
+	serverConfig := res.currentServerConfig()
+	if serverConfig.Cache.Enabled {
+		res.cache = newResponseCache(serverConfig.Cache.Size, serverConfig.Cache.NegativeTTL)
+	}
+	if serverConfig.RateLimit.QPS > 0 {
+		limiter, err := newRateLimiter(serverConfig.RateLimit)
+		if err != nil {
+			return fmt.Errorf("invalid server configuration: %w", err)
+		}
+		res.limiter = limiter
+	}
+	secrets, algorithms, err := parseTSIGKeys(serverConfig.TSIGKeys)
+	if err != nil {
+		return fmt.Errorf("invalid server configuration: %w", err)
+	}
+	res.tsigAlgorithms = algorithms
+	servers, err := res.newServers(serverConfig, secrets)
 	if err != nil {
-		fmt.Printf("Failed to start server: %v\n", err)
+		return fmt.Errorf("invalid server configuration: %w", err)
+	}
+	if cfg := serverConfig.Tracing; cfg.Endpoint != "" {
+		stopTracing, err := res.startTracing(cfg)
+		if err != nil {
+			return fmt.Errorf("invalid server configuration: %w", err)
+		}
+		defer stopTracing()
+		res.logger.Info("exporting traces", "endpoint", cfg.Endpoint, "sample_ratio", cfg.SampleRatio)
+	}
+
+	if serverConfig.Metrics.Listen != "" {
+		res.serveMetrics(serverConfig.Metrics.Listen)
+	}
+	if serverConfig.API.Listen != "" {
+		res.serveAPI(serverConfig.API, path)
+	}
+
+	var bound sync.WaitGroup
+	bound.Add(len(servers))
+	go func() {
+		bound.Wait()
+		res.listening.Store(true)
+	}()
+	errs := make(chan error, len(servers)+1)
+	for _, server := range servers {
+		server.NotifyStartedFunc = bound.Done
+		go func() {
+			errs <- fmt.Errorf("%s listener on %s: %w", server.Net, server.Addr, listenAndServe(server, serverConfig))
+		}()
+		res.logger.Info("starting DNS listener", "net", server.Net, "listen", server.Addr)
+	}
+
+	var doh *http.Server
+	if cfg := serverConfig.DoH; cfg.Listen != "" {
+		doh = res.newDoHServer(cfg)
+		go func() {
+			errs <- fmt.Errorf("DNS-over-HTTPS listener on %s: %w", cfg.Listen, serveDoH(doh, cfg))
+		}()
+		res.logger.Info("starting DNS-over-HTTPS listener", "listen", cfg.Listen, "path", cfg.Path)
+	}
+
+	if err := res.watchRecords(path); err != nil {
+		res.logger.Error("failed to watch records file", "path", path, "err", err)
+	}
+	res.reloadOnSignal(path)
+
+	select {
+	case err := <-errs:
+		res.shutdownServers(servers, doh, 0)
+		return err
+	case sig := <-stop:
+		grace := serverConfig.ShutdownGrace
+		res.logger.Info("shutting down", "signal", sig.String(), "grace", grace)
+		res.shutdownServers(servers, doh, grace)
+		res.logger.Info("server stopped")
+		return nil
+	}
+}
+
+// newServers builds the DNS listeners described by cfg, all answering with
+// res and verifying TSIG signatures against secrets.
+func (res *Resolver) newServers(cfg ServerConfig, secrets map[string]string) ([]*dns.Server, error) {
+	var nets []string
+	switch cfg.Net {
+	case "both":
+		nets = []string{"udp", "tcp"}
+	case "udp", "tcp":
+		nets = []string{cfg.Net}
+	default:
+		return nil, fmt.Errorf("unsupported server net %q: must be udp, tcp or both", cfg.Net)
+	}
+
+	handler := dns.HandlerFunc(res.handleDNSRequest)
+	var servers []*dns.Server
+	for _, n := range nets {
+		servers = append(servers, &dns.Server{Addr: cfg.Listen, Net: n, Handler: handler, TsigSecret: secrets, MsgAcceptFunc: acceptMsg, UDPSize: cfg.UDPSize})
+	}
+
+	if cfg.TLS.Listen != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			return nil, fmt.Errorf("loading DNS-over-TLS certificate: %w", err)
+		}
+		servers = append(servers, &dns.Server{
+			Addr:          cfg.TLS.Listen,
+			Net:           "tcp-tls",
+			TLSConfig:     &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+			Handler:       handler,
+			TsigSecret:    secrets,
+			MsgAcceptFunc: acceptMsg,
+		})
+	}
+	return servers, nil
+}
+
+// shutdownServers stops every listener from accepting new queries and waits
+// up to grace for in-flight handlers to finish. doh may be nil.
+func (res *Resolver) shutdownServers(servers []*dns.Server, doh *http.Server, grace time.Duration) {
+	res.listening.Store(false)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.ShutdownContext(ctx); err != nil && grace > 0 {
+			res.logger.Warn("listener did not shut down cleanly", "net", server.Net, "err", err)
+		}
+	}
+	if doh != nil {
+		if err := doh.Shutdown(ctx); err != nil && grace > 0 {
+			res.logger.Warn("DNS-over-HTTPS listener did not shut down cleanly", "err", err)
+		}
 	}
 }
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestResolver writes yml to a records file in a temporary directory and
+// loads it into a new resolver, built with opts, that discards its logs.
+func newTestResolver(t testing.TB, yml string, opts ...ResolverOption) (*Resolver, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dns_records.yml")
+	if err := os.WriteFile(path, []byte(yml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res := NewResolver(slog.New(slog.DiscardHandler), opts...)
+	if err := res.loadRecords(path); err != nil {
+		t.Fatalf("loading records: %v", err)
+	}
+	return res, path
+}
+
+// ask sends a query for name through the resolver's DNS handler, as a UDP
+// client on the loopback address would, and returns the reply.
+func ask(t testing.TB, res *Resolver, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	return exchangeWith(t, res, r)
+}
+
+// exchangeWith sends r through the resolver's DNS handler and returns the
+// reply.
+func exchangeWith(t testing.TB, res *Resolver, r *dns.Msg) *dns.Msg {
+	t.Helper()
+	w := &testWriter{}
+	res.handleDNSRequest(w, r)
+	if len(w.msgs) != 1 {
+		t.Fatalf("handler wrote %d replies, want 1", len(w.msgs))
+	}
+	return w.msgs[0]
+}
+
+// testWriter is a dns.ResponseWriter that keeps the messages written to it.
+// With failAt set, the write with that number, counting from 1, fails.
+type testWriter struct {
+	remote net.Addr
+	failAt int
+	msgs   []*dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testWriter) RemoteAddr() net.Addr {
+	if w.remote != nil {
+		return w.remote
+	}
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	if w.failAt > 0 && len(w.msgs)+1 == w.failAt {
+		return errors.New("connection reset")
+	}
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+
+func (w *testWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testWriter) Close() error                { return nil }
+func (w *testWriter) TsigStatus() error           { return nil }
+func (w *testWriter) TsigTimersOnly(bool)         {}
+func (w *testWriter) Hijack()                     {}
+
+// TestReloadDuringQueries answers queries from many goroutines while the
+// records are reloaded, for go test -race to check. Every answer must come
+// from one complete set of records or the other.
+func TestReloadDuringQueries(t *testing.T) {
+	records := func(ip string) string {
+		var b strings.Builder
+		b.WriteString("records:\n")
+		for i := range 50 {
+			fmt.Fprintf(&b, "  - hostname: host%d.lan\n    ip: %s\n", i, ip)
+		}
+		return b.String()
+	}
+	res, path := newTestResolver(t, records("10.0.0.1"))
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				r := new(dns.Msg)
+				r.SetQuestion(fmt.Sprintf("host%d.lan.", (g+i)%50), dns.TypeA)
+				w := &testWriter{}
+				res.handleDNSRequest(w, r)
+				if len(w.msgs) != 1 {
+					t.Errorf("handler wrote %d replies, want 1", len(w.msgs))
+					return
+				}
+				m := w.msgs[0]
+				if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+					t.Errorf("query during reload: rcode %s, %d answers", dns.RcodeToString[m.Rcode], len(m.Answer))
+					return
+				}
+				if ip := m.Answer[0].(*dns.A).A.String(); ip != "10.0.0.1" && ip != "10.0.0.2" {
+					t.Errorf("answer %s from neither set of records", ip)
+					return
+				}
+			}
+		}()
+	}
+	for i := range 20 {
+		if err := os.WriteFile(path, []byte(records(fmt.Sprintf("10.0.0.%d", i%2+1))), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := res.loadRecords(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// TestMixedCaseQueries checks that names are matched without regard to
+// case, whether the query or the records file uses capitals.
+func TestMixedCaseQueries(t *testing.T) {
+	res, _ := newTestResolver(t, `records:
+  - hostname: printer.lan
+    ip: 10.0.0.5
+  - hostname: NAS.Lan
+    ip: 10.0.0.6
+  - hostname: "*.Dev.lan"
+    ip: 10.0.0.7
+`)
+	for name, want := range map[string]string{
+		"PRINTER.LAN.": "10.0.0.5",
+		"Printer.Lan.": "10.0.0.5",
+		"nas.lan.":     "10.0.0.6",
+		"nAs.LAN.":     "10.0.0.6",
+		"App.DEV.lan.": "10.0.0.7",
+		"api.dev.LAN.": "10.0.0.7",
+	} {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		m, status := res.answerQuery(context.Background(), r, netip.MustParseAddr("127.0.0.1"))
+		if status != "matched" || len(m.Answer) != 1 {
+			t.Errorf("%s: status %s, %d answers", name, status, len(m.Answer))
+			continue
+		}
+		if got := m.Answer[0].(*dns.A).A.String(); got != want {
+			t.Errorf("%s = %s, want %s", name, got, want)
+		}
+	}
+}
+
+// TestReloadWaitsForEdits checks that a reload doesn't run while an edit
+// holds the records, so it can't be overwritten by the edit's stale copy.
+func TestReloadWaitsForEdits(t *testing.T) {
+	res, path := newTestResolver(t, "records:\n  - hostname: a.lan\n    ip: 10.0.0.1\n")
+	if err := os.WriteFile(path, []byte("records:\n  - hostname: a.lan\n    ip: 10.0.0.2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	res.editMu.Lock()
+	reloaded := make(chan error)
+	go func() { reloaded <- res.loadRecords(path) }()
+	select {
+	case <-reloaded:
+		t.Fatal("reload ran during an edit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	res.editMu.Unlock()
+	if err := <-reloaded; err != nil {
+		t.Fatal(err)
+	}
+	if m := ask(t, res, "a.lan.", dns.TypeA); m.Answer[0].(*dns.A).A.String() != "10.0.0.2" {
+		t.Errorf("after reload a.lan = %v", m.Answer)
+	}
+}
+
+// BenchmarkHandleDNSRequest drives the handler with a mix of exact, CNAME,
+// wildcard and missing names over 4000 records, on its own and while the
+// records are reloaded back to back.
+func BenchmarkHandleDNSRequest(b *testing.B) {
+	var yml strings.Builder
+	yml.WriteString("records:\n")
+	for i := range 1000 {
+		fmt.Fprintf(&yml, "  - hostname: host%d.lan\n    ip: 10.0.%d.%d\n", i, i/256, i%256)
+		fmt.Fprintf(&yml, "  - hostname: alias%d.lan\n    type: CNAME\n    target: host%d.lan\n", i, i)
+		fmt.Fprintf(&yml, "  - hostname: \"*.dev%d.lan\"\n    ip: 10.1.%d.%d\n", i, i/256, i%256)
+		fmt.Fprintf(&yml, "  - hostname: mail%d.lan\n    ip: 10.2.%d.%d\n", i, i/256, i%256)
+	}
+	res, path := newTestResolver(b, yml.String())
+	names := make([]string, 0, 400)
+	for i := range 100 {
+		names = append(names,
+			fmt.Sprintf("host%d.lan.", i*10),
+			fmt.Sprintf("alias%d.lan.", i*10),
+			fmt.Sprintf("app.dev%d.lan.", i*10),
+			fmt.Sprintf("missing%d.lan.", i*10),
+		)
+	}
+	query := func(i int) {
+		r := new(dns.Msg)
+		r.SetQuestion(names[i%len(names)], dns.TypeA)
+		res.handleDNSRequest(&testWriter{}, r)
+	}
+
+	b.Run("steady", func(b *testing.B) {
+		for i := 0; b.Loop(); i++ {
+			query(i)
+		}
+	})
+	b.Run("reloading", func(b *testing.B) {
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := res.loadRecords(path); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				query(i)
+			}
+		})
+		close(stop)
+		<-done
+	})
+}
+
+// TestMultipleQuestions checks that queries without exactly one question
+// get FORMERR, and that multiple_questions: first answers the first one.
+func TestMultipleQuestions(t *testing.T) {
+	records := "records:\n  - hostname: printer.lan\n    ip: 10.0.0.5\n  - hostname: nas.lan\n    ip: 10.0.0.6\n"
+	twoQuestions := func() *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("printer.lan.", dns.TypeA)
+		r.Question = append(r.Question, dns.Question{Name: "nas.lan.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		return r
+	}
+
+	res, _ := newTestResolver(t, records)
+	if m := exchangeWith(t, res, twoQuestions()); m.Rcode != dns.RcodeFormatError || len(m.Answer) != 0 {
+		t.Errorf("two questions: rcode %s, answers %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	r := new(dns.Msg)
+	r.Id = dns.Id()
+	if m := exchangeWith(t, res, r); m.Rcode != dns.RcodeFormatError {
+		t.Errorf("no question: rcode %s", dns.RcodeToString[m.Rcode])
+	}
+
+	res, _ = newTestResolver(t, "server:\n  multiple_questions: first\n"+records)
+	m := exchangeWith(t, res, twoQuestions())
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.0.5" {
+		t.Fatalf("first: rcode %s, answers %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	if len(m.Question) != 1 || m.Question[0].Name != "printer.lan." {
+		t.Errorf("first: question section %v", m.Question)
+	}
+}
+
+// TestAcceptMultipleQuestions checks that the listener's accept function
+// passes queries with several questions to the handler rather than
+// rejecting them before it sees them.
+func TestAcceptMultipleQuestions(t *testing.T) {
+	for qdcount, want := range map[uint16]dns.MsgAcceptAction{1: dns.MsgAccept, 2: dns.MsgAccept, 5: dns.MsgAccept, 0: dns.MsgReject} {
+		if got := acceptMsg(dns.Header{Qdcount: qdcount}); got != want {
+			t.Errorf("query with %d questions: action %v, want %v", qdcount, got, want)
+		}
+	}
+
+	res, _ := newTestResolver(t, "server:\n  multiple_questions: first\nrecords:\n  - hostname: printer.lan\n    ip: 10.0.0.5\n")
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        conn,
+		Handler:           dns.HandlerFunc(res.handleDNSRequest),
+		MsgAcceptFunc:     acceptMsg,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+
+	r := new(dns.Msg)
+	r.SetQuestion("printer.lan.", dns.TypeA)
+	r.Question = append(r.Question, dns.Question{Name: "nas.lan.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	m, _, err := new(dns.Client).Exchange(r, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Errorf("two questions over UDP: rcode %s, answers %v", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+}
+
+// TestRandomizedCase checks that answers to a query whose name has its
+// case randomized, as resolvers using 0x20 encoding send, echo the name
+// exactly as it was asked.
+func TestRandomizedCase(t *testing.T) {
+	res, _ := newTestResolver(t, `records:
+  - hostname: printer.lan
+    ip: 10.0.0.5
+  - hostname: "*.dev.lan"
+    ip: 10.0.0.7
+  - hostname: www.lan
+    type: CNAME
+    target: printer.lan
+`)
+	for name, owners := range map[string][]string{
+		"PrInTeR.lAn.": {"PrInTeR.lAn."},
+		"aPp.DeV.lAn.": {"aPp.DeV.lAn."},
+		"wWw.LaN.":     {"wWw.LaN.", "printer.lan."},
+	} {
+		m := ask(t, res, name, dns.TypeA)
+		if m.Question[0].Name != name {
+			t.Errorf("%s: question echoed as %s", name, m.Question[0].Name)
+		}
+		if len(m.Answer) != len(owners) {
+			t.Errorf("%s: answers %v", name, m.Answer)
+			continue
+		}
+		for i, rr := range m.Answer {
+			if rr.Header().Name != owners[i] {
+				t.Errorf("%s: answer %d owned by %s, want %s", name, i, rr.Header().Name, owners[i])
+			}
+		}
+	}
+}
+
+// TestEmptyNonTerminal checks that a name with no records of its own but
+// records below it gets an empty answer with the SOA, not NXDOMAIN, so
+// resolvers minimizing their queries carry on down to the names below.
+func TestEmptyNonTerminal(t *testing.T) {
+	res, _ := newTestResolver(t, `zones:
+  - name: example.com
+    ns: ns1.example.com
+records:
+  - hostname: a.b.example.com
+    ip: 192.0.2.1
+`)
+	m := ask(t, res, "b.example.com.", dns.TypeA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 || !m.Authoritative {
+		t.Fatalf("b.example.com: rcode %s, aa %v, answers %v; want an empty answer", dns.RcodeToString[m.Rcode], m.Authoritative, m.Answer)
+	}
+	if len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("b.example.com: authority %v, want the SOA", m.Ns)
+	}
+	for _, name := range []string{"c.b.example.com.", "b.b.example.com.", "missing.example.com."} {
+		if m := ask(t, res, name, dns.TypeA); m.Rcode != dns.RcodeNameError {
+			t.Errorf("%s: rcode %s, want NXDOMAIN", name, dns.RcodeToString[m.Rcode])
+		}
+	}
+	if m := ask(t, res, "a.b.example.com.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("a.b.example.com: answers %v", m.Answer)
+	}
+}
+
+// TestWildcardClosestEncloser checks that a wildcard only answers below the
+// closest name that exists, as RFC 4592 requires.
+func TestWildcardClosestEncloser(t *testing.T) {
+	res, _ := newTestResolver(t, `zones:
+  - name: example.com
+    ns: ns1.example.com
+records:
+  - hostname: "*.example.com"
+    ip: 192.0.2.1
+  - hostname: dev.example.com
+    ip: 192.0.2.2
+  - hostname: a.ent.example.com
+    ip: 192.0.2.3
+  - hostname: "*.dev2.example.com"
+    ip: 192.0.2.4
+`)
+	for name, want := range map[string]string{
+		"x.example.com.":        "192.0.2.1",
+		"x.y.example.com.":      "192.0.2.1",
+		"dev.example.com.":      "192.0.2.2",
+		"a.ent.example.com.":    "192.0.2.3",
+		"x.dev2.example.com.":   "192.0.2.4",
+		"x.y.dev2.example.com.": "192.0.2.4",
+	} {
+		m := ask(t, res, name, dns.TypeA)
+		if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != want {
+			t.Errorf("%s: answers %v, want %s", name, m.Answer, want)
+		}
+	}
+	for name, rcode := range map[string]int{
+		"x.dev.example.com.": dns.RcodeNameError,
+		"x.ent.example.com.": dns.RcodeNameError,
+		"ent.example.com.":   dns.RcodeSuccess,
+		"dev2.example.com.":  dns.RcodeSuccess,
+	} {
+		m := ask(t, res, name, dns.TypeA)
+		if m.Rcode != rcode || len(m.Answer) != 0 {
+			t.Errorf("%s: rcode %s, answers %v; want %s and no answers", name, dns.RcodeToString[m.Rcode], m.Answer, dns.RcodeToString[rcode])
+		}
+	}
+}
+
+// TestWeightedAnswers checks that over a full cycle of queries each address
+// leads answers in proportion to its weight, that one of weight 0 never
+// does, and that every address is in every answer.
+func TestWeightedAnswers(t *testing.T) {
+	res, _ := newTestResolver(t, `records:
+  - hostname: web.lan
+    ips:
+      - "10.0.0.1"
+      - ip: "10.0.0.2"
+        weight: 3
+      - ip: "10.0.0.3"
+        weight: 0
+`, WithSeed(1))
+	leads := make(map[string]int)
+	for range 400 {
+		m := ask(t, res, "web.lan.", dns.TypeA)
+		if len(m.Answer) != 3 {
+			t.Fatalf("answers %v, want all three addresses", m.Answer)
+		}
+		leads[m.Answer[0].(*dns.A).A.String()]++
+	}
+	want := map[string]int{"10.0.0.1": 100, "10.0.0.2": 300}
+	if len(leads) != len(want) || leads["10.0.0.1"] != want["10.0.0.1"] || leads["10.0.0.2"] != want["10.0.0.2"] {
+		t.Errorf("addresses led %v answers, want %v", leads, want)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	queriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dns_queries_total",
+		Help: "Total number of DNS queries received.",
+	})
+	queriesByType = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_queries_by_type_total",
+		Help: "DNS queries received, partitioned by query type.",
+	}, []string{"type"})
+	nxdomainTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dns_nxdomain_responses_total",
+		Help: "Responses sent with RCODE NXDOMAIN.",
+	})
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dns_cache_hits_total",
+		Help: "Forwarded queries answered from a cached positive response.",
+	})
+	cacheNegativeHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dns_cache_negative_hits_total",
+		Help: "Forwarded queries answered from a cached NXDOMAIN or empty response.",
+	})
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dns_cache_misses_total",
+		Help: "Forwarded queries not found in the cache.",
+	})
+	upstreamFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_upstream_failures_total",
+		Help: "Failed or timed out attempts to forward a query, partitioned by upstream.",
+	}, []string{"upstream"})
+	rateLimitedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dns_rate_limited_total",
+		Help: "Queries refused or dropped by the per-client rate limiter.",
+	})
+	blockedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dns_blocked_queries_total",
+		Help: "Queries answered from the blocklist.",
+	})
+	policyHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_policy_hits_total",
+		Help: "Queries matched by a policy rule, partitioned by rule and action.",
+	}, []string{"rule", "action"})
+	responseDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dns_response_duration_seconds",
+		Help:    "Time taken to answer DNS queries.",
+		Buckets: prometheus.ExponentialBuckets(0.00005, 4, 10),
+	})
+)
+
+func recordQueryMetrics(r, m *dns.Msg, latency time.Duration) {
+	queriesTotal.Inc()
+	for _, q := range r.Question {
+		queriesByType.WithLabelValues(dns.TypeToString[q.Qtype]).Inc()
+	}
+	if m.Rcode == dns.RcodeNameError {
+		nxdomainTotal.Inc()
+	}
+	responseDuration.Observe(latency.Seconds())
+}
+
+// serveMetrics exposes the Prometheus metrics on addr at /metrics, next to
+// the health check at /healthz. It runs in the background so a failing
+// metrics listener never stops DNS serving.
+func (res *Resolver) serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", res.healthz)
+	go func() {
+		res.logger.Info("serving metrics", "listen", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			res.logger.Error("metrics server failed", "listen", addr, "err", err)
+		}
+	}()
+}
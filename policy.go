@@ -0,0 +1,97 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// PolicyRule overrides the answer for names matching Match, in the style of
+// a response policy zone. Match is a name, or "*." followed by a name to
+// match everything beneath it. Action is nxdomain, nodata, drop, passthru,
+// or redirect followed by an address. Name identifies the rule in logs and
+// metrics and defaults to Match.
+type PolicyRule struct {
+	Name   string `yaml:"name"`
+	Match  string `yaml:"match"`
+	Action string `yaml:"action"`
+}
+
+// policyRule is a parsed PolicyRule.
+type policyRule struct {
+	name     string
+	match    string
+	action   string
+	redirect net.IP
+}
+
+// parsePolicy validates rules, keeping their order.
+func parsePolicy(rules []PolicyRule) ([]*policyRule, error) {
+	var parsed []*policyRule
+	for _, rule := range rules {
+		base, wildcard := strings.CutPrefix(rule.Match, "*.")
+		if _, ok := dns.IsDomainName(base); !ok || base == "" || strings.Contains(base, "*") {
+			return nil, fmt.Errorf("policy match %q is not a valid name or wildcard", rule.Match)
+		}
+		p := &policyRule{name: cmp.Or(rule.Name, rule.Match), match: dns.CanonicalName(base)}
+		if wildcard {
+			p.match = "*." + p.match
+		}
+
+		fields := strings.Fields(rule.Action)
+		if len(fields) > 0 {
+			p.action = strings.ToLower(fields[0])
+		}
+		switch {
+		case len(fields) == 1 && (p.action == "nxdomain" || p.action == "nodata" || p.action == "drop" || p.action == "passthru"):
+		case len(fields) == 2 && p.action == "redirect":
+			if p.redirect = net.ParseIP(fields[1]); p.redirect == nil {
+				return nil, fmt.Errorf("policy rule %q: invalid redirect address %q", p.name, fields[1])
+			}
+		default:
+			return nil, fmt.Errorf("policy rule %q: unsupported action %q: must be nxdomain, nodata, drop, passthru or redirect <ip>", p.name, rule.Action)
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// matches reports whether the rule applies to the canonical name.
+func (p *policyRule) matches(name string) bool {
+	if suffix, wildcard := strings.CutPrefix(p.match, "*."); wildcard {
+		return name != suffix && dns.IsSubDomain(suffix, name)
+	}
+	return name == p.match
+}
+
+// matchPolicy returns the first policy rule that applies to name, or nil.
+func (res *Resolver) matchPolicy(name string) *policyRule {
+	name = dns.CanonicalName(name)
+	for _, p := range res.loaded().policy {
+		if p.matches(name) {
+			return p
+		}
+	}
+	return nil
+}
+
+// apply answers q in m as the rule says and returns the query status, or ""
+// for passthru, which leaves the query to the normal lookup.
+func (p *policyRule) apply(m *dns.Msg, q dns.Question, ttl uint32) string {
+	switch p.action {
+	case "passthru":
+		return ""
+	case "drop":
+		return "dropped"
+	case "nxdomain":
+		m.Rcode = dns.RcodeNameError
+	case "redirect":
+		if rr := addressRecord(q.Name, p.redirect, ttl); rr.Header().Rrtype == q.Qtype {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	return "policy"
+}
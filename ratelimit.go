@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often idle client buckets are discarded.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per client IP. A bucket that has refilled
+// completely holds no state worth keeping, so the sweeper drops it and the
+// client starts again from a full bucket on its next query.
+type rateLimiter struct {
+	mu      sync.Mutex
+	qps     float64
+	burst   float64
+	refuse  bool
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(cfg RateLimitConfig) (*rateLimiter, error) {
+	if cfg.Action != "refuse" && cfg.Action != "drop" {
+		return nil, fmt.Errorf("unsupported rate_limit action %q: must be refuse or drop", cfg.Action)
+	}
+	burst := cfg.Burst
+	if burst < 1 {
+		burst = max(1, int(math.Ceil(cfg.QPS)))
+	}
+	l := &rateLimiter{
+		qps:     cfg.QPS,
+		burst:   float64(burst),
+		refuse:  cfg.Action == "refuse",
+		buckets: make(map[string]*bucket),
+	}
+	go func() {
+		for range time.Tick(sweepInterval) {
+			l.sweep()
+		}
+	}()
+	return l, nil
+}
+
+func (l *rateLimiter) allow(client string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, found := l.buckets[client]
+	if !found {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.qps)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *rateLimiter) sweep() {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.qps >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
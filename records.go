@@ -0,0 +1,411 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile converts internationalized names the way resolvers do before
+// sending them, while still allowing underscores as used in SRV names.
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// toASCII converts an internationalized name to its punycode form. ASCII
+// names are returned unchanged.
+func toASCII(name string) (string, error) {
+	if isASCII(name) {
+		return name, nil
+	}
+	rest, wildcard := strings.CutPrefix(name, "*.")
+	ascii, err := idnaProfile.ToASCII(rest)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a valid internationalized domain name: %w", name, err)
+	}
+	if wildcard {
+		ascii = "*." + ascii
+	}
+	return ascii, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// ownerName returns the key records for hostname are stored under: its
+// canonical ASCII form, matching what arrives on the wire.
+func ownerName(hostname string) (string, error) {
+	ascii, err := toASCII(hostname)
+	if err != nil {
+		return "", err
+	}
+	return dns.CanonicalName(ascii), nil
+}
+
+// expandAliases returns records with every record that has aliases
+// replaced by one copy per name, so each name is validated and stored on
+// its own.
+func expandAliases(records []DNSRecord) []DNSRecord {
+	var expanded []DNSRecord
+	for _, record := range records {
+		for _, hostname := range record.hostnames() {
+			alias := record
+			alias.Hostname, alias.Aliases = hostname, nil
+			expanded = append(expanded, alias)
+		}
+	}
+	return expanded
+}
+
+// hostnames returns the record's hostname followed by its aliases.
+func (r DNSRecord) hostnames() []string {
+	return slices.Concat([]string{r.Hostname}, r.Aliases)
+}
+
+// owns reports whether name, an owner name, is one of the record's
+// hostnames.
+func (r DNSRecord) owns(name string) bool {
+	return slices.ContainsFunc(r.hostnames(), func(hostname string) bool {
+		owner, _ := ownerName(hostname)
+		return owner == name
+	})
+}
+
+// only returns the record with name, one of its hostnames, as its sole
+// hostname.
+func (r DNSRecord) only(name string) DNSRecord {
+	for _, hostname := range r.hostnames() {
+		if owner, _ := ownerName(hostname); owner == name {
+			r.Hostname, r.Aliases = hostname, nil
+			return r
+		}
+	}
+	return r
+}
+
+// without returns the record with name taken out of its hostnames, and
+// false if no other hostname is left.
+func (r DNSRecord) without(name string) (DNSRecord, bool) {
+	rest := slices.DeleteFunc(r.hostnames(), func(hostname string) bool {
+		owner, _ := ownerName(hostname)
+		return owner == name
+	})
+	if len(rest) == 0 {
+		return DNSRecord{}, false
+	}
+	r.Hostname, r.Aliases = rest[0], nil
+	if len(rest) > 1 {
+		r.Aliases = rest[1:]
+	}
+	return r, true
+}
+
+// parseRecord validates record and builds the resource records it describes
+// for the owner name.
+func parseRecord(record DNSRecord, name string, ttl uint32) ([]dns.RR, error) {
+	if record.Hostname == "" {
+		return nil, errors.New("hostname is empty")
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("hostname %q is not a valid domain name", record.Hostname)
+	}
+	if strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+		return nil, fmt.Errorf("hostname %q may only use * as its leftmost label", record.Hostname)
+	}
+
+	rrtype := strings.ToUpper(record.Type)
+	if field := unexpectedField(record, rrtype); field != "" {
+		return nil, fmt.Errorf("field %q does not apply to %s records", field, recordTypeName(rrtype))
+	}
+
+	switch rrtype {
+	case "", "A", "AAAA":
+		var ips []string
+		if record.IP != "" {
+			ips = append(ips, record.IP)
+		}
+		for _, ip := range record.IPs {
+			if ip.Weight != nil && *ip.Weight < 0 {
+				return nil, fmt.Errorf("weight of %s must not be negative", ip.IP)
+			}
+			ips = append(ips, ip.IP)
+		}
+		if len(ips) == 0 && len(record.Views) == 0 {
+			return nil, errors.New("no ip, ips or views given")
+		}
+		return parseAddresses(ips, rrtype, name, ttl)
+	case "CNAME":
+		target, err := parseTarget(record.Target)
+		if err != nil {
+			return nil, err
+		}
+		return []dns.RR{&dns.CNAME{Hdr: rrHeader(name, dns.TypeCNAME, ttl), Target: target}}, nil
+	case "NS":
+		target, err := parseTarget(record.Target)
+		if err != nil {
+			return nil, err
+		}
+		return []dns.RR{&dns.NS{Hdr: rrHeader(name, dns.TypeNS, ttl), Ns: target}}, nil
+	case "PTR":
+		target, err := parseTarget(record.Target)
+		if err != nil {
+			return nil, err
+		}
+		return []dns.RR{&dns.PTR{Hdr: rrHeader(name, dns.TypePTR, ttl), Ptr: target}}, nil
+	case "MX":
+		target, err := parseTarget(record.Target)
+		if err != nil {
+			return nil, err
+		}
+		return []dns.RR{&dns.MX{Hdr: rrHeader(name, dns.TypeMX, ttl), Preference: record.Preference, Mx: target}}, nil
+	case "SRV":
+		target, err := parseTarget(record.Target)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range []struct {
+			name  string
+			value int
+		}{{"priority", record.Priority}, {"weight", record.Weight}, {"port", record.Port}} {
+			if field.value < 0 || field.value > math.MaxUint16 {
+				return nil, fmt.Errorf("%s %d is out of range 0-%d", field.name, field.value, math.MaxUint16)
+			}
+		}
+		return []dns.RR{&dns.SRV{
+			Hdr:      rrHeader(name, dns.TypeSRV, ttl),
+			Priority: uint16(record.Priority),
+			Weight:   uint16(record.Weight),
+			Port:     uint16(record.Port),
+			Target:   target,
+		}}, nil
+	case "TXT":
+		if len(record.Text) == 0 {
+			return nil, errors.New("no text given")
+		}
+		var txt []string
+		for _, text := range record.Text {
+			txt = append(txt, splitTXT(text)...)
+		}
+		return []dns.RR{&dns.TXT{Hdr: rrHeader(name, dns.TypeTXT, ttl), Txt: txt}}, nil
+	case "CAA":
+		tag := strings.ToLower(record.Tag)
+		if !slices.Contains([]string{"issue", "issuewild", "iodef"}, tag) {
+			return nil, fmt.Errorf("unsupported CAA tag %q: must be issue, issuewild or iodef", record.Tag)
+		}
+		if tag == "iodef" && record.Value == "" {
+			return nil, errors.New("iodef requires a value")
+		}
+		if record.Flag < 0 || record.Flag > math.MaxUint8 {
+			return nil, fmt.Errorf("flag %d is out of range 0-%d", record.Flag, math.MaxUint8)
+		}
+		return []dns.RR{&dns.CAA{Hdr: rrHeader(name, dns.TypeCAA, ttl), Flag: uint8(record.Flag), Tag: tag, Value: record.Value}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported record type %q", record.Type)
+	}
+}
+
+// parseAddresses builds address records for ips, checking each against the
+// family required by rrtype.
+func parseAddresses(ips []string, rrtype, name string, ttl uint32) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, value := range ips {
+		ip := net.ParseIP(value)
+		switch {
+		case ip == nil:
+			return nil, fmt.Errorf("invalid IP address %q", value)
+		case rrtype == "A" && ip.To4() == nil:
+			return nil, fmt.Errorf("%s is not an IPv4 address", value)
+		case rrtype == "AAAA" && ip.To4() != nil:
+			return nil, fmt.Errorf("%s is not an IPv6 address", value)
+		}
+		rrs = append(rrs, addressRecord(name, ip, ttl))
+	}
+	return rrs, nil
+}
+
+// ipWeights returns the weight of each address of record in the order
+// parseRecord builds them, or nil if none of them is weighted.
+func ipWeights(record DNSRecord) []int {
+	var weights []int
+	weighted := false
+	if record.IP != "" {
+		weights = append(weights, 1)
+	}
+	for _, ip := range record.IPs {
+		if ip.Weight == nil {
+			weights = append(weights, 1)
+			continue
+		}
+		weights = append(weights, *ip.Weight)
+		weighted = true
+	}
+	if !weighted {
+		return nil
+	}
+	return weights
+}
+
+// parseViews builds the client-specific addresses of an address record. It
+// returns nothing for records without views.
+func parseViews(record DNSRecord, name string, ttl uint32) ([]addressView, error) {
+	var views []addressView
+	for cidr, ips := range record.Views {
+		prefixes, err := parsePrefixes([]string{cidr})
+		if err != nil {
+			return nil, fmt.Errorf("view %w", err)
+		}
+		rrs, err := parseAddresses(ips, strings.ToUpper(record.Type), name, ttl)
+		if err != nil {
+			return nil, fmt.Errorf("view %s: %w", cidr, err)
+		}
+		views = append(views, addressView{prefix: prefixes[0], addresses: rrs})
+	}
+	return views, nil
+}
+
+// unexpectedField returns the name of a field that is set on record but has
+// no meaning for rrtype, or "" if there is none.
+func unexpectedField(record DNSRecord, rrtype string) string {
+	isAddress := rrtype == "" || rrtype == "A" || rrtype == "AAAA"
+	switch {
+	case !isAddress && record.IP != "":
+		return "ip"
+	case !isAddress && len(record.IPs) > 0:
+		return "ips"
+	case !isAddress && len(record.Views) > 0:
+		return "views"
+	case !slices.Contains([]string{"CNAME", "NS", "PTR", "MX", "SRV"}, rrtype) && record.Target != "":
+		return "target"
+	case rrtype != "MX" && record.Preference != 0:
+		return "preference"
+	case rrtype != "TXT" && len(record.Text) > 0:
+		return "text"
+	case rrtype != "SRV" && record.Priority != 0:
+		return "priority"
+	case rrtype != "SRV" && record.Weight != 0:
+		return "weight"
+	case rrtype != "SRV" && record.Port != 0:
+		return "port"
+	case rrtype != "CAA" && record.Flag != 0:
+		return "flag"
+	case rrtype != "CAA" && record.Tag != "":
+		return "tag"
+	case rrtype != "CAA" && record.Value != "":
+		return "value"
+	}
+	return ""
+}
+
+// addReversePointers adds a PTR record for every forward address whose
+// reverse name has no records of its own, and returns how many were added.
+func addReversePointers(records map[string]*hostRecords) int {
+	ptrs := make(map[string]*hostRecords)
+	count := 0
+	for _, name := range slices.Sorted(maps.Keys(records)) {
+		if strings.HasPrefix(name, "*.") {
+			continue
+		}
+		for _, rr := range records[name].addresses {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			}
+			reverse, err := dns.ReverseAddr(ip.String())
+			if err != nil {
+				continue
+			}
+			if _, explicit := records[reverse]; explicit {
+				continue
+			}
+			if ptrs[reverse] == nil {
+				ptrs[reverse] = &hostRecords{}
+			}
+			ptrs[reverse].add(&dns.PTR{Hdr: rrHeader(reverse, dns.TypePTR, rr.Header().Ttl), Ptr: name})
+			count++
+		}
+	}
+	maps.Copy(records, ptrs)
+	return count
+}
+
+func recordTypeName(rrtype string) string {
+	if rrtype == "" {
+		return "address"
+	}
+	return rrtype
+}
+
+func parseTarget(target string) (string, error) {
+	target, err := toASCII(target)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := dns.IsDomainName(target); !ok {
+		return "", fmt.Errorf("target %q is not a valid domain name", target)
+	}
+	return dns.Fqdn(target), nil
+}
+
+// splitTXT breaks s into the 255-byte character-strings that the TXT wire
+// format requires.
+func splitTXT(s string) []string {
+	var parts []string
+	for len(s) > 255 {
+		parts = append(parts, s[:255])
+		s = s[255:]
+	}
+	return append(parts, s)
+}
+
+func rrHeader(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+}
+
+// parseCatchAll parses the catch_all addresses answered for names that
+// match nothing else.
+func parseCatchAll(values []string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, value := range values {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", value)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// catchAllAnswers synthesizes the catch-all records for q, owned by the
+// queried name. Only addresses of the queried family are returned.
+func catchAllAnswers(q dns.Question, ips []net.IP, ttl uint32) []dns.RR {
+	var answers []dns.RR
+	for _, ip := range ips {
+		rr := addressRecord(q.Name, ip, ttl)
+		if q.Qtype == rr.Header().Rrtype || q.Qtype == dns.TypeANY {
+			answers = append(answers, rr)
+		}
+	}
+	return answers
+}
+
+func addressRecord(name string, ip net.IP, ttl uint32) dns.RR {
+	if ip.To4() == nil {
+		return &dns.AAAA{Hdr: rrHeader(name, dns.TypeAAAA, ttl), AAAA: ip}
+	}
+	return &dns.A{Hdr: rrHeader(name, dns.TypeA, ttl), A: ip}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Resolver answers DNS queries from one set of records. It holds everything
+// a query depends on, so independent resolvers can run side by side and a
+// test can build one with fixed records and call answerQuery directly,
+// without a socket. handleDNSRequest has the signature dns.HandleFunc
+// expects.
+type Resolver struct {
+	current atomic.Pointer[snapshot]
+	logger  *slog.Logger
+
+	// level is the level logger's handler logs at, set from log_level when
+	// a config is applied. It is nil unless WithLogLevel provides it, and
+	// log_level is then ignored.
+	level *slog.LevelVar
+
+	// cache and limiter are nil unless enabled in the configuration the
+	// server was started with.
+	cache     *responseCache
+	limiter   *rateLimiter
+	upstreams *upstreamHealth
+	stats     *recordStats
+
+	// tsigAlgorithms maps the name of each TSIG key configured at startup to
+	// its algorithm. The dns.Server only knows the secrets, so this is what
+	// stops a client from picking a weaker algorithm than the key was issued
+	// for.
+	tsigAlgorithms map[string]string
+
+	// reloadFailed is set while the most recent load of the records has
+	// failed, and listening once every DNS listener is bound. Both feed the
+	// health check.
+	reloadFailed atomic.Bool
+	listening    atomic.Bool
+
+	// editMu serializes changes to the records, from the API, dynamic
+	// updates and reloads, so concurrent changes can't lose each other's
+	// edits.
+	editMu sync.Mutex
+
+	// rand picks where each name's rotation starts when records load, so
+	// replicas and reloads don't all lead with the same address, and how
+	// far ttl_jitter lowers each answer's TTLs. It is seeded from the clock
+	// unless WithSeed fixes it.
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	// tracer starts a span for every query. It does nothing unless tracing
+	// is configured.
+	tracer trace.Tracer
+}
+
+// ResolverOption configures a Resolver built by NewResolver.
+type ResolverOption func(*Resolver)
+
+// WithSeed makes the order in which addresses rotate, and the TTL jitter,
+// reproducible, for tests that check exactly what a query gets.
+func WithSeed(seed uint64) ResolverOption {
+	return WithRandSource(rand.NewPCG(seed, seed))
+}
+
+// WithRandSource sets the source the resolver draws rotation offsets from.
+func WithRandSource(src rand.Source) ResolverOption {
+	return func(res *Resolver) { res.rand = rand.New(src) }
+}
+
+// WithLogLevel lets the resolver set level, which its logger's handler must
+// log at, from log_level.
+func WithLogLevel(level *slog.LevelVar) ResolverOption {
+	return func(res *Resolver) { res.level = level }
+}
+
+// NewResolver returns a resolver with no records that logs to logger. Load
+// records into it with loadRecords or applyConfig.
+func NewResolver(logger *slog.Logger, opts ...ResolverOption) *Resolver {
+	now := uint64(time.Now().UnixNano())
+	res := &Resolver{
+		logger:    logger,
+		upstreams: &upstreamHealth{failures: make(map[string]int), skipped: make(map[string]time.Time)},
+		stats:     newRecordStats(),
+		rand:      rand.New(rand.NewPCG(now, now>>32)),
+		tracer:    noopTracer,
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+// seedRotation starts the rotation of every name in records at a random
+// position. Names are visited in sorted order so that a fixed seed always
+// gives the same positions.
+func (res *Resolver) seedRotation(records map[string]*hostRecords) {
+	res.randMu.Lock()
+	defer res.randMu.Unlock()
+	for _, name := range slices.Sorted(maps.Keys(records)) {
+		records[name].next.Store(res.rand.Uint64())
+	}
+}
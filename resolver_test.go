@@ -0,0 +1,53 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// TestWithSeed checks that resolvers built with the same seed and records
+// rotate addresses the same way and jitter TTLs alike, and that another
+// seed changes what they answer.
+func TestWithSeed(t *testing.T) {
+	const records = `server:
+  ttl_jitter:
+    percent: 50
+records:
+  - hostname: web.lan
+    ips: ["10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"]
+    ttl: 3600
+  - hostname: db.lan
+    ips: ["10.0.1.1", "10.0.1.2", "10.0.1.3", "10.0.1.4", "10.0.1.5"]
+    ttl: 3600
+`
+	answers := func(seed uint64) []string {
+		res, _ := newTestResolver(t, records, WithSeed(seed))
+		var got []string
+		for range 20 {
+			for _, name := range []string{"web.lan.", "db.lan."} {
+				m := ask(t, res, name, dns.TypeA)
+				if len(m.Answer) != 5 {
+					t.Fatalf("%s: answers %v", name, m.Answer)
+				}
+				for _, rr := range m.Answer {
+					got = append(got, rr.String())
+				}
+			}
+		}
+		return got
+	}
+
+	first, second := answers(7), answers(7)
+	if !slices.ContainsFunc(first, func(rr string) bool { return !strings.Contains(rr, "\t3600\t") }) {
+		t.Fatal("no TTL was jittered")
+	}
+	if !slices.Equal(first, second) {
+		t.Errorf("resolvers with the same seed answered differently:\n%v\n%v", first, second)
+	}
+	if slices.Equal(first, answers(8)) {
+		t.Error("resolvers with different seeds answered alike")
+	}
+}
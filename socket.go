@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// listenAndServe starts server. The dns package has no option for socket
+// buffer sizes, so when read_buffer or write_buffer is set the socket is
+// opened here, sized, and handed to the server.
+func listenAndServe(server *dns.Server, cfg ServerConfig) error {
+	if cfg.ReadBuffer == 0 && cfg.WriteBuffer == 0 {
+		return server.ListenAndServe()
+	}
+	switch server.Net {
+	case "udp":
+		conn, err := net.ListenPacket("udp", server.Addr)
+		if err != nil {
+			return err
+		}
+		if err := setBuffers(conn.(*net.UDPConn), cfg); err != nil {
+			conn.Close()
+			return err
+		}
+		server.PacketConn = conn
+	default:
+		l, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			return err
+		}
+		server.Listener = bufferedListener{l.(*net.TCPListener), cfg}
+		if server.Net == "tcp-tls" {
+			server.Listener = tls.NewListener(server.Listener, server.TLSConfig)
+		}
+	}
+	return server.ActivateAndServe()
+}
+
+// bufferedListener sizes the buffers of every connection it accepts.
+type bufferedListener struct {
+	*net.TCPListener
+	cfg ServerConfig
+}
+
+func (l bufferedListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	if err := setBuffers(conn, l.cfg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// setBuffers applies the configured socket buffer sizes to conn, leaving
+// the operating system's default for any that are zero. The kernel may cap
+// them, on Linux at net.core.rmem_max and net.core.wmem_max.
+func setBuffers(conn interface {
+	SetReadBuffer(int) error
+	SetWriteBuffer(int) error
+}, cfg ServerConfig) error {
+	if cfg.ReadBuffer > 0 {
+		if err := conn.SetReadBuffer(cfg.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if cfg.WriteBuffer > 0 {
+		return conn.SetWriteBuffer(cfg.WriteBuffer)
+	}
+	return nil
+}
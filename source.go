@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// BackendConfig selects where records come from besides the records file
+// itself. The default "yaml" backend reads the files listed in include;
+// "sqlite" reads rows of hostname, type, value and ttl from Table in the
+// database at Path.
+type BackendConfig struct {
+	Type  string `yaml:"type"`
+	Path  string `yaml:"path"`
+	Table string `yaml:"table"`
+}
+
+// recordSource supplies the records served alongside those written in the
+// records file. It is read again on every reload, and String names it in
+// logs.
+type recordSource interface {
+	read() ([]DNSRecord, error)
+	String() string
+}
+
+// newRecordSource returns the source selected by config, which was loaded
+// from the records file at path. DNS_RECORDS takes precedence over the
+// backend when it is set.
+func newRecordSource(config Config, path string) (recordSource, error) {
+	if value, ok := os.LookupEnv(recordsEnv); ok {
+		return envSource(value), nil
+	}
+	switch config.Backend.Type {
+	case "", "yaml":
+		return yamlSource{path: path, include: config.Include}, nil
+	case "sqlite":
+		if config.Backend.Path == "" {
+			return nil, errors.New("sqlite backend requires a path")
+		}
+		if len(config.Include) > 0 {
+			return nil, errors.New("include only applies to the yaml backend")
+		}
+		db := config.Backend.Path
+		if !filepath.IsAbs(db) {
+			db = filepath.Join(filepath.Dir(path), db)
+		}
+		table := config.Backend.Table
+		if table == "" {
+			table = "records"
+		}
+		return newSQLiteSource(db, table)
+	}
+	return nil, fmt.Errorf("unsupported backend type %q: must be yaml or sqlite", config.Backend.Type)
+}
+
+// yamlSource reads the YAML files included from the records file at path.
+type yamlSource struct {
+	path    string
+	include []string
+}
+
+func (s yamlSource) read() ([]DNSRecord, error) {
+	absPath, err := filepath.Abs(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return readIncludes(s.path, s.include, []string{absPath})
+}
+
+func (s yamlSource) String() string { return "yaml" }
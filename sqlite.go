@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sqliteSource reads records from a table with hostname, type, value and
+// ttl columns. value holds the record data in zone file order, such as
+// "10 mail.example.com" for MX or "0 issue letsencrypt.org" for CAA, and a
+// NULL ttl uses the default.
+type sqliteSource struct {
+	path  string
+	table string
+}
+
+func newSQLiteSource(path, table string) (*sqliteSource, error) {
+	if !sqlIdentifier.MatchString(table) {
+		return nil, fmt.Errorf("invalid sqlite table name %q", table)
+	}
+	return &sqliteSource{path: path, table: table}, nil
+}
+
+func (s *sqliteSource) String() string { return "sqlite" }
+
+func (s *sqliteSource) read() ([]DNSRecord, error) {
+	db, err := sql.Open("sqlite", "file:"+s.path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT hostname, type, value, ttl FROM "` + s.table + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	defer rows.Close()
+
+	var records []DNSRecord
+	for row := 1; rows.Next(); row++ {
+		var hostname, rrtype, value string
+		var ttl sql.NullInt64
+		if err := rows.Scan(&hostname, &rrtype, &value, &ttl); err != nil {
+			return nil, fmt.Errorf("%s: row %d: %w", s.path, row, err)
+		}
+		record := rowRecord(hostname, rrtype, value)
+		if ttl.Valid {
+			t := uint32(ttl.Int64)
+			record.TTL = &t
+		}
+		record.line, record.source = row, s.path
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// rowRecord converts a table row to a record. Malformed values are passed
+// on as they are, so the loader skips the record with a warning.
+func rowRecord(hostname, rrtype, value string) DNSRecord {
+	record := DNSRecord{Hostname: hostname, Type: rrtype}
+	fields := strings.Fields(value)
+	number := func(i int) int {
+		n, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	switch strings.ToUpper(rrtype) {
+	case "", "A", "AAAA":
+		record.IP = value
+	case "TXT":
+		record.Text = stringList{value}
+	case "MX":
+		if len(fields) == 2 {
+			if preference, err := strconv.ParseUint(fields[0], 10, 16); err == nil {
+				record.Preference = uint16(preference)
+				record.Target = fields[1]
+			}
+		}
+	case "SRV":
+		if len(fields) == 4 {
+			record.Priority, record.Weight, record.Port = number(0), number(1), number(2)
+			record.Target = fields[3]
+		}
+	case "CAA":
+		if len(fields) >= 2 {
+			record.Flag, record.Tag = number(0), fields[1]
+			_, rest, _ := strings.Cut(strings.TrimSpace(value), fields[1])
+			record.Value = strings.Trim(strings.TrimSpace(rest), `"`)
+		}
+	default:
+		record.Target = value
+	}
+	return record
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type statsKey struct {
+	name  string
+	qtype uint16
+}
+
+type hitCount struct {
+	hits int64
+	last time.Time
+}
+
+// recordStats holds hit counts per (hostname, type) for the stats endpoint.
+type recordStats struct {
+	mu     sync.Mutex
+	counts map[statsKey]*hitCount
+}
+
+func newRecordStats() *recordStats {
+	return &recordStats{counts: make(map[statsKey]*hitCount)}
+}
+
+// count records a hit for qtype at owner, the name of the record that
+// answered it.
+func (s *recordStats) count(owner string, qtype uint16, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := statsKey{owner, qtype}
+	c := s.counts[key]
+	if c == nil {
+		c = &hitCount{}
+		s.counts[key] = c
+	}
+	c.hits++
+	c.last = now
+}
+
+// countHit counts r in the stats when it was answered from the local
+// records. Names matched by a wildcard are counted under the wildcard, so
+// queries for any number of them share one entry.
+func (res *Resolver) countHit(r *dns.Msg, status string, now time.Time) {
+	if status != "matched" {
+		return
+	}
+	owner, _ := res.matchHost(r.Question[0].Name)
+	res.stats.count(owner, r.Question[0].Qtype, now)
+}
+
+func (s *recordStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.counts)
+}
+
+type recordHits struct {
+	Hostname    string    `json:"hostname"`
+	Type        string    `json:"type"`
+	Hits        int64     `json:"hits"`
+	LastQueried time.Time `json:"last_queried"`
+}
+
+type zoneHits struct {
+	Zone        string    `json:"zone"`
+	Hits        int64     `json:"hits"`
+	LastQueried time.Time `json:"last_queried"`
+}
+
+type statsReport struct {
+	Records []recordHits `json:"records"`
+	Zones   []zoneHits   `json:"zones"`
+}
+
+// report returns the counts sorted by hostname and type, along with totals
+// for each of zones that has been queried.
+func (s *recordStats) report(zones map[string]*zone) statsReport {
+	report := statsReport{Records: []recordHits{}, Zones: []zoneHits{}}
+	byZone := make(map[*zone]*zoneHits)
+
+	s.mu.Lock()
+	for key, c := range s.counts {
+		report.Records = append(report.Records, recordHits{
+			Hostname:    key.name,
+			Type:        dns.TypeToString[key.qtype],
+			Hits:        c.hits,
+			LastQueried: c.last,
+		})
+		z := encloser(zones, key.name)
+		if z == nil {
+			continue
+		}
+		total := byZone[z]
+		if total == nil {
+			total = &zoneHits{Zone: z.soa.Hdr.Name}
+			byZone[z] = total
+		}
+		total.Hits += c.hits
+		if c.last.After(total.LastQueried) {
+			total.LastQueried = c.last
+		}
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(report.Records, func(a, b recordHits) int {
+		return cmp.Or(strings.Compare(a.Hostname, b.Hostname), strings.Compare(a.Type, b.Type))
+	})
+	for _, total := range byZone {
+		report.Zones = append(report.Zones, *total)
+	}
+	slices.SortFunc(report.Zones, func(a, b zoneHits) int {
+		return strings.Compare(a.Zone, b.Zone)
+	})
+	return report
+}
+
+func (api *recordsAPI) stats(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, api.res.stats.report(api.res.loaded().zones))
+}
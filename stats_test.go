@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// TestStatsWildcard checks that names answered by a wildcard are counted
+// under the wildcard, so querying many of them keeps one entry.
+func TestStatsWildcard(t *testing.T) {
+	res, _ := newTestResolver(t, `records:
+  - hostname: printer.lan
+    ip: 10.0.0.5
+  - hostname: "*.dev.lan"
+    ip: 10.0.0.7
+`)
+	for i := range 100 {
+		ask(t, res, fmt.Sprintf("app%d.dev.lan.", i), dns.TypeA)
+	}
+	ask(t, res, "Printer.LAN.", dns.TypeA)
+	ask(t, res, "missing.lan.", dns.TypeA)
+
+	report := res.stats.report(res.loaded().zones)
+	want := []recordHits{{Hostname: "*.dev.lan.", Type: "A", Hits: 100}, {Hostname: "printer.lan.", Type: "A", Hits: 1}}
+	if len(report.Records) != len(want) {
+		t.Fatalf("report holds %v, want %v", report.Records, want)
+	}
+	for i, got := range report.Records {
+		if got.Hostname != want[i].Hostname || got.Type != want[i].Type || got.Hits != want[i].Hits {
+			t.Errorf("entry %d = %s %s %d hits, want %s %s %d", i, got.Hostname, got.Type, got.Hits, want[i].Hostname, want[i].Type, want[i].Hits)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// TracingConfig exports an OpenTelemetry span for every query to an OTLP
+// collector over HTTP when Endpoint, a host and port such as
+// localhost:4318, is set. Insecure sends spans without TLS. SampleRatio is
+// the share of queries traced, unless the trace was started by a DoH client.
+type TracingConfig struct {
+	Endpoint    string  `yaml:"endpoint"`
+	Insecure    bool    `yaml:"insecure"`
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// noopTracer is the resolver's tracer while tracing is off. Its spans do
+// nothing and cost next to nothing.
+var noopTracer = noop.NewTracerProvider().Tracer("")
+
+// startTracing points the resolver's tracer at the collector in cfg. The
+// returned function flushes any spans still buffered and stops the
+// exporter.
+func (res *Resolver) startTracing(cfg TracingConfig) (func(), error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("tracing exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName))),
+	)
+	res.tracer = provider.Tracer("github.com/petrusjohannesmaas/dns-server")
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			res.logger.Warn("failed to flush traces", "err", err)
+		}
+	}, nil
+}
+
+// startQuerySpan starts the span for r, received over transport. For DoH,
+// header carries the client's trace context, so the query joins its trace.
+func (res *Resolver) startQuerySpan(r *dns.Msg, transport string, header http.Header) (context.Context, trace.Span) {
+	ctx := context.Background()
+	if header != nil {
+		ctx = propagation.TraceContext{}.Extract(ctx, propagation.HeaderCarrier(header))
+	}
+	attrs := []attribute.KeyValue{attribute.String("network.transport", transport)}
+	if len(r.Question) > 0 {
+		attrs = append(attrs,
+			attribute.String("dns.question.name", r.Question[0].Name),
+			attribute.String("dns.question.type", dns.TypeToString[r.Question[0].Qtype]),
+		)
+	}
+	return res.tracer.Start(ctx, "dns.query", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// endQuerySpan records how the query was answered and ends its span.
+func endQuerySpan(span trace.Span, m *dns.Msg, status string, latency time.Duration) {
+	span.SetAttributes(
+		attribute.String("dns.status", status),
+		attribute.String("dns.response.code", dns.RcodeToString[m.Rcode]),
+		attribute.Float64("dns.latency_ms", float64(latency)/float64(time.Millisecond)),
+	)
+	if m.Rcode == dns.RcodeServerFailure {
+		span.SetStatus(codes.Error, "SERVFAIL")
+	}
+	span.End()
+}
+
+// startUpstreamSpan starts the span for one attempt at forwarding a query
+// to upstream.
+func (res *Resolver) startUpstreamSpan(ctx context.Context, upstream string) (context.Context, trace.Span) {
+	return res.tracer.Start(ctx, "dns.forward", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("server.address", upstream)))
+}
+
+// endUpstreamSpan records the outcome of a forwarding attempt and ends its
+// span.
+func endUpstreamSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// markCacheHit records on the query span in ctx whether a forwarded query
+// was answered from the cache.
+func markCacheHit(ctx context.Context, hit bool) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("dns.cache_hit", hit))
+}
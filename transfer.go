@@ -0,0 +1,91 @@
+package main
+
+import (
+	"maps"
+	"net"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// transferChunk is the number of records sent in each AXFR message.
+const transferChunk = 100
+
+// serveTransfer answers an AXFR query for one of the configured zones by
+// streaming every record in it between two copies of its SOA. Transfers
+// are only served over TCP, to clients in the zone's allow_transfer list or
+// signed with one of its transfer_keys.
+func (res *Resolver) serveTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	client := w.RemoteAddr().String()
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		res.refuse(w, r)
+		return
+	}
+	z := res.loaded().zones[dns.CanonicalName(q.Name)]
+	addr, ok := remoteAddr(client)
+	if z == nil || !(ok && containsAddr(z.transfer, addr) || res.signedWith(w, r, z.transferKeys)) {
+		res.logger.Warn("refused zone transfer", "client", client, "zone", q.Name)
+		res.refuse(w, r)
+		return
+	}
+
+	rrs := res.zoneRecords(z)
+	if err := sendTransfer(w, r, rrs); err != nil {
+		res.logger.Error("zone transfer failed", "client", client, "zone", q.Name, "err", err)
+		return
+	}
+	res.logger.Info("zone transfer", "client", client, "zone", q.Name, "serial", z.soa.Serial, "records", len(rrs))
+}
+
+// sendTransfer streams rrs to the client transferChunk records at a time.
+// If a write fails, Out stops reading the channel, so the send gives up as
+// soon as Out returns instead of waiting for it forever.
+func sendTransfer(w dns.ResponseWriter, r *dns.Msg, rrs []dns.RR) error {
+	ch := make(chan *dns.Envelope)
+	done := make(chan error, 1)
+	go func() {
+		done <- new(dns.Transfer).Out(w, r, ch)
+	}()
+	for chunk := range slices.Chunk(rrs, transferChunk) {
+		select {
+		case ch <- &dns.Envelope{RR: chunk}:
+		case err := <-done:
+			return err
+		}
+	}
+	close(ch)
+	return <-done
+}
+
+// zoneRecords returns the records of z in transfer order: the SOA, every
+// other record in the zone sorted by name, and the SOA again. Names that
+// belong to a more specific configured zone are left out, as are
+// client-specific view addresses.
+func (res *Resolver) zoneRecords(z *zone) []dns.RR {
+	snap := res.loaded()
+	rrs := []dns.RR{z.soa}
+	for _, name := range slices.Sorted(maps.Keys(snap.records)) {
+		if encloser(snap.zones, name) != z {
+			continue
+		}
+		host := snap.records[name]
+		if host.cname != nil {
+			rrs = append(rrs, host.cname)
+		}
+		rrs = append(rrs, host.addresses...)
+		for _, rr := range host.records {
+			if rr != z.soa {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+	return append(rrs, z.soa)
+}
+
+func (res *Resolver) refuse(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+	res.signReply(w, m, r)
+	w.WriteMsg(m)
+}
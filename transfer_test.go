@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// transferRecords returns a zone example.com, open to transfers from the
+// loopback address, holding n hosts.
+func transferRecords(n int) string {
+	var b strings.Builder
+	b.WriteString("zones:\n  - name: example.com\n    ns: ns1.example.com\n    allow_transfer: [\"127.0.0.1\"]\nrecords:\n")
+	for i := range n {
+		fmt.Fprintf(&b, "  - hostname: host%d.example.com\n    ip: 192.0.2.%d\n", i, i%256)
+	}
+	return b.String()
+}
+
+func axfr(t *testing.T, res *Resolver, w *testWriter) {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetAxfr("example.com.")
+	done := make(chan struct{})
+	go func() {
+		res.handleDNSRequest(w, r)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("zone transfer never returned")
+	}
+}
+
+// TestTransfer checks that a zone is sent in chunks between two SOAs.
+func TestTransfer(t *testing.T) {
+	res, _ := newTestResolver(t, transferRecords(350))
+	w := &testWriter{remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+	axfr(t, res, w)
+	if len(w.msgs) != 4 {
+		t.Fatalf("transfer sent %d messages, want 4", len(w.msgs))
+	}
+	var rrs []dns.RR
+	for _, m := range w.msgs {
+		rrs = append(rrs, m.Answer...)
+	}
+	if len(rrs) != 352 {
+		t.Errorf("transfer sent %d records, want 352", len(rrs))
+	}
+	if _, ok := rrs[0].(*dns.SOA); !ok {
+		t.Errorf("transfer starts with %v", rrs[0])
+	}
+	if _, ok := rrs[len(rrs)-1].(*dns.SOA); !ok {
+		t.Errorf("transfer ends with %v", rrs[len(rrs)-1])
+	}
+}
+
+// TestTransferWriteFails checks that a transfer whose connection fails
+// partway returns instead of blocking on the records still to be sent.
+func TestTransferWriteFails(t *testing.T) {
+	res, _ := newTestResolver(t, transferRecords(350))
+	w := &testWriter{remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, failAt: 2}
+	axfr(t, res, w)
+	if len(w.msgs) != 1 {
+		t.Errorf("transfer sent %d messages before failing, want 1", len(w.msgs))
+	}
+}
+
+// TestTransferOverUDP checks that transfers are only served over TCP.
+func TestTransferOverUDP(t *testing.T) {
+	res, _ := newTestResolver(t, transferRecords(1))
+	w := &testWriter{}
+	axfr(t, res, w)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeRefused {
+		t.Errorf("transfer over UDP: %v", w.msgs)
+	}
+}
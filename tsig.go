@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TSIGKey is a shared secret that clients can sign zone transfers and
+// dynamic updates with. Secret is base64 encoded, as tsig-keygen prints it.
+type TSIGKey struct {
+	Name      string `yaml:"name"`
+	Algorithm string `yaml:"algorithm"`
+	Secret    string `yaml:"secret"`
+}
+
+var tsigAlgorithmNames = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// parseTSIGKeys validates keys and returns their secrets in the form
+// dns.Server.TsigSecret expects, along with the algorithm of each key.
+func parseTSIGKeys(keys []TSIGKey) (secrets, algorithms map[string]string, err error) {
+	secrets = make(map[string]string)
+	algorithms = make(map[string]string)
+	for _, key := range keys {
+		if _, ok := dns.IsDomainName(key.Name); !ok || key.Name == "" {
+			return nil, nil, fmt.Errorf("invalid tsig key name %q", key.Name)
+		}
+		name := dns.CanonicalName(key.Name)
+		if _, found := secrets[name]; found {
+			return nil, nil, fmt.Errorf("tsig key %q is defined twice", key.Name)
+		}
+		algorithm := key.Algorithm
+		if algorithm == "" {
+			algorithm = "hmac-sha256"
+		}
+		alg, ok := tsigAlgorithmNames[algorithm]
+		if !ok {
+			return nil, nil, fmt.Errorf("tsig key %q: unsupported algorithm %q", key.Name, key.Algorithm)
+		}
+		if _, err := base64.StdEncoding.DecodeString(key.Secret); err != nil || key.Secret == "" {
+			return nil, nil, fmt.Errorf("tsig key %q: secret must be base64 encoded", key.Name)
+		}
+		secrets[name] = key.Secret
+		algorithms[name] = alg
+	}
+	return secrets, algorithms, nil
+}
+
+// tsigError returns the TSIG error for the signature on r, which the server
+// has already checked against the configured secrets, or dns.RcodeSuccess
+// if r is unsigned or correctly signed.
+func (res *Resolver) tsigError(w dns.ResponseWriter, r *dns.Msg) int {
+	t := r.IsTsig()
+	if t == nil {
+		return dns.RcodeSuccess
+	}
+	alg, found := res.tsigAlgorithms[t.Hdr.Name]
+	if !found || alg != dns.CanonicalName(t.Algorithm) {
+		return dns.RcodeBadKey
+	}
+	switch err := w.TsigStatus(); {
+	case err == nil:
+		return dns.RcodeSuccess
+	case errors.Is(err, dns.ErrTime):
+		return dns.RcodeBadTime
+	case errors.Is(err, dns.ErrSecret):
+		return dns.RcodeBadKey
+	}
+	return dns.RcodeBadSig
+}
+
+// writeTSIGError answers r with NOTAUTH and a TSIG record carrying tsigErr.
+// The reply is left unsigned, as RFC 8945 requires when the key or signature
+// can't be trusted.
+func (res *Resolver) writeTSIGError(w dns.ResponseWriter, r *dns.Msg, tsigErr int) {
+	t := r.IsTsig()
+	res.logger.Warn("rejected TSIG signature", "client", w.RemoteAddr().String(), "name", questionName(r), "key", t.Hdr.Name, "error", dns.RcodeToString[tsigErr])
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNotAuth)
+	m.Extra = append(m.Extra, &dns.TSIG{
+		Hdr:        dns.RR_Header{Name: t.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm:  t.Algorithm,
+		TimeSigned: uint64(time.Now().Unix()),
+		Fudge:      t.Fudge,
+		OrigId:     r.Id,
+		Error:      uint16(tsigErr),
+	})
+	packed, err := m.Pack()
+	if err == nil {
+		_, err = w.Write(packed)
+	}
+	if err != nil {
+		res.logger.Error("failed to write response", "client", w.RemoteAddr().String(), "name", questionName(r), "err", err)
+	}
+}
+
+// signReply asks the server to sign m with the key r was signed with, so
+// signed requests get signed replies.
+func (res *Resolver) signReply(w dns.ResponseWriter, m, r *dns.Msg) {
+	if t := r.IsTsig(); t != nil && res.tsigError(w, r) == dns.RcodeSuccess {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, t.Fudge, time.Now().Unix())
+	}
+}
+
+// signedWith reports whether r carries a valid signature by one of keys.
+func (res *Resolver) signedWith(w dns.ResponseWriter, r *dns.Msg, keys []string) bool {
+	t := r.IsTsig()
+	return t != nil && res.tsigError(w, r) == dns.RcodeSuccess && slices.Contains(keys, t.Hdr.Name)
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// serveUpdate applies a dynamic update (RFC 2136) to one of the configured
+// zones and answers with the resulting RCODE. Updates are only accepted from
+// clients in the zone's allow_update list or signed with one of its
+// update_keys. Changes are written back to the records file before they are
+// served, so they survive a restart.
+func (res *Resolver) serveUpdate(w dns.ResponseWriter, r *dns.Msg) {
+	client := w.RemoteAddr().String()
+	rcode := res.applyUpdate(w, r)
+	if rcode == dns.RcodeRefused {
+		res.logger.Warn("refused dynamic update", "client", client, "zone", questionName(r))
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	res.signReply(w, m, r)
+	if err := w.WriteMsg(m); err != nil {
+		res.logger.Error("failed to write response", "client", client, "name", questionName(r), "err", err)
+	}
+}
+
+func (res *Resolver) applyUpdate(w dns.ResponseWriter, r *dns.Msg) int {
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	zoneName := dns.CanonicalName(r.Question[0].Name)
+
+	res.editMu.Lock()
+	defer res.editMu.Unlock()
+	snap := res.loaded()
+	z := snap.zones[zoneName]
+	if z == nil {
+		return dns.RcodeNotAuth
+	}
+	client := w.RemoteAddr().String()
+	addr, ok := remoteAddr(client)
+	if !(ok && containsAddr(z.update, addr) || res.signedWith(w, r, z.updateKeys)) {
+		return dns.RcodeRefused
+	}
+
+	if rcode := checkPrerequisites(snap, zoneName, r.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	for _, rr := range r.Ns {
+		if rcode := res.prescanUpdate(zoneName, rr); rcode != dns.RcodeSuccess {
+			return rcode
+		}
+	}
+
+	edit := newRecordsEdit(snap.config)
+	for _, rr := range r.Ns {
+		name := dns.CanonicalName(rr.Header().Name)
+		switch rr.Header().Class {
+		case dns.ClassINET:
+			edit.add(rr)
+		case dns.ClassANY:
+			if rr.Header().Rrtype == dns.TypeANY {
+				edit.deleteName(name, zoneName)
+			} else {
+				edit.deleteRRset(name, rr.Header().Rrtype, zoneName)
+			}
+		case dns.ClassNONE:
+			edit.deleteRR(name, rr, zoneName)
+		}
+	}
+	if !edit.changed {
+		return dns.RcodeSuccess
+	}
+
+	// Every applied update raises the zone's serial (RFC 2136 section 3.6).
+	// One left unset already increases on every reload; a configured one
+	// is raised here and written back with the records.
+	config := snap.config
+	serial, bumped := bumpSerial(&config, zoneName, z.soa.Serial)
+	if config.fileRecords >= 0 {
+		err := editRecordsFile(snap.path, config.fileRecords, func(root, seq *yaml.Node) error {
+			if err := edit.persist(seq); err != nil {
+				return err
+			}
+			if bumped {
+				return setZoneSerial(root, zoneName, serial)
+			}
+			return nil
+		})
+		if err != nil {
+			res.logger.Error("failed to persist dynamic update", "path", snap.path, "err", err)
+			return dns.RcodeServerFailure
+		}
+		config.fileRecords = edit.fileRecords
+	}
+	config.Records = edit.records()
+	res.applyConfig(config, snap.path)
+	res.logger.Info("dynamic update", "client", client, "zone", zoneName, "records", len(config.Records))
+	return dns.RcodeSuccess
+}
+
+// bumpSerial raises the serial configured for zoneName in config to follow
+// current, the one being served, and returns it. The boolean is false, and
+// config unchanged, for a zone without a configured serial.
+func bumpSerial(config *Config, zoneName string, current uint32) (uint32, bool) {
+	i := slices.IndexFunc(config.Zones, func(zc ZoneConfig) bool { return dns.CanonicalName(zc.Name) == zoneName })
+	if i < 0 || config.Zones[i].Serial == 0 {
+		return 0, false
+	}
+	serial := current + 1
+	if serial == 0 {
+		serial = 1
+	}
+	config.Zones = slices.Clone(config.Zones)
+	config.Zones[i].Serial = serial
+	return serial, true
+}
+
+// setZoneSerial sets the serial of zoneName in the zones list of the records
+// file, whose top-level mapping is root.
+func setZoneSerial(root *yaml.Node, zoneName string, serial uint32) error {
+	value := strconv.FormatUint(uint64(serial), 10)
+	for _, zones := range mappingValues(root, "zones") {
+		for _, zc := range zones.Content {
+			names := mappingValues(zc, "name")
+			if len(names) == 0 || dns.CanonicalName(names[0].Value) != zoneName {
+				continue
+			}
+			if serials := mappingValues(zc, "serial"); len(serials) > 0 {
+				serials[0].Value = value
+				return nil
+			}
+			zc.Content = append(zc.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Value: "serial"},
+				&yaml.Node{Kind: yaml.ScalarNode, Value: value})
+			return nil
+		}
+	}
+	return fmt.Errorf("zone %s isn't in the records file", zoneName)
+}
+
+// mappingValues returns the values of key in the YAML mapping node.
+func mappingValues(node *yaml.Node, key string) []*yaml.Node {
+	var values []*yaml.Node
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			values = append(values, node.Content[i+1])
+		}
+	}
+	return values
+}
+
+// checkPrerequisites evaluates the prerequisite section of an update to
+// zoneName against the records being served (RFC 2136 section 3.2).
+func checkPrerequisites(snap *snapshot, zoneName string, prereqs []dns.RR) int {
+	type rrset struct {
+		name   string
+		rrtype uint16
+	}
+	required := make(map[rrset][]dns.RR)
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		name := dns.CanonicalName(hdr.Name)
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zoneName, name) {
+			return dns.RcodeNotZone
+		}
+		host := snap.records[name]
+		inUse := host != nil && host.size() > 0
+		switch hdr.Class {
+		case dns.ClassANY:
+			switch {
+			case hdr.Rrtype == dns.TypeANY && !inUse:
+				return dns.RcodeNameError
+			case hdr.Rrtype != dns.TypeANY && len(host.rrset(hdr.Rrtype)) == 0:
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			switch {
+			case hdr.Rrtype == dns.TypeANY && inUse:
+				return dns.RcodeYXDomain
+			case hdr.Rrtype != dns.TypeANY && len(host.rrset(hdr.Rrtype)) > 0:
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			key := rrset{name, hdr.Rrtype}
+			required[key] = append(required[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for key, want := range required {
+		have := snap.records[key.name].rrset(key.rrtype)
+		if !sameRRs(want, have) || !sameRRs(have, want) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// sameRRs reports whether every record in a is also in b, ignoring TTLs.
+func sameRRs(a, b []dns.RR) bool {
+	for _, rr := range a {
+		if !slices.ContainsFunc(b, func(other dns.RR) bool { return dns.IsDuplicate(rr, other) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// rrset returns the records of type rrtype held for the host, leaving out
+// client-specific views.
+func (host *hostRecords) rrset(rrtype uint16) []dns.RR {
+	switch {
+	case host == nil:
+		return nil
+	case rrtype == dns.TypeA || rrtype == dns.TypeAAAA:
+		return filterType(host.addresses, rrtype)
+	case rrtype == dns.TypeCNAME && host.cname != nil:
+		return []dns.RR{host.cname}
+	}
+	return filterType(host.records, rrtype)
+}
+
+// prescanUpdate checks one record of the update section before anything is
+// changed (RFC 2136 section 3.4.1).
+func (res *Resolver) prescanUpdate(zoneName string, rr dns.RR) int {
+	hdr := rr.Header()
+	if !dns.IsSubDomain(zoneName, dns.CanonicalName(hdr.Name)) {
+		return dns.RcodeNotZone
+	}
+	if hdr.Rrtype == dns.TypeAXFR || hdr.Rrtype == dns.TypeIXFR {
+		return dns.RcodeFormatError
+	}
+	switch hdr.Class {
+	case dns.ClassINET:
+		if hdr.Rrtype == dns.TypeANY {
+			return dns.RcodeFormatError
+		}
+		if hdr.Rrtype == dns.TypeSOA {
+			return dns.RcodeSuccess
+		}
+		record, ok := recordFromRR(rr)
+		if !ok {
+			return dns.RcodeNotImplemented
+		}
+		name, err := ownerName(record.Hostname)
+		if err == nil {
+			_, err = parseRecord(record, name, hdr.Ttl)
+		}
+		if err != nil {
+			res.logger.Debug("rejected dynamic update record", "record", rr.String(), "err", err)
+			return dns.RcodeNotImplemented
+		}
+	case dns.ClassANY:
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+	case dns.ClassNONE:
+		if hdr.Ttl != 0 || hdr.Rrtype == dns.TypeANY {
+			return dns.RcodeFormatError
+		}
+	default:
+		return dns.RcodeFormatError
+	}
+	return dns.RcodeSuccess
+}
+
+// recordFromRR converts rr to the equivalent entry of the records file. The
+// boolean is false for types the records file can't hold.
+func recordFromRR(rr dns.RR) (DNSRecord, bool) {
+	hdr := rr.Header()
+	ttl := hdr.Ttl
+	record := DNSRecord{
+		Hostname: strings.TrimSuffix(hdr.Name, "."),
+		Type:     dns.TypeToString[hdr.Rrtype],
+		TTL:      &ttl,
+	}
+	switch rr := rr.(type) {
+	case *dns.A:
+		record.IP = rr.A.String()
+	case *dns.AAAA:
+		record.IP = rr.AAAA.String()
+	case *dns.CNAME:
+		record.Target = rr.Target
+	case *dns.NS:
+		record.Target = rr.Ns
+	case *dns.PTR:
+		record.Target = rr.Ptr
+	case *dns.MX:
+		record.Preference = rr.Preference
+		record.Target = rr.Mx
+	case *dns.SRV:
+		record.Priority = int(rr.Priority)
+		record.Weight = int(rr.Weight)
+		record.Port = int(rr.Port)
+		record.Target = rr.Target
+	case *dns.TXT:
+		record.Text = stringList(rr.Txt)
+	case *dns.CAA:
+		record.Flag = int(rr.Flag)
+		record.Tag = rr.Tag
+		record.Value = rr.Value
+	default:
+		return DNSRecord{}, false
+	}
+	return record, true
+}
+
+// recordsEdit collects the changes an update makes to the records of the
+// main records file, so they can be persisted and applied together. Records
+// from the backend, such as included files, are taken into account but are
+// never changed.
+type recordsEdit struct {
+	entries    []editEntry
+	sourced    []DNSRecord
+	defaultTTL uint32
+	changed    bool
+	// fileRecords is the number of records in the records file once
+	// persist has rewritten it.
+	fileRecords int
+}
+
+type editEntry struct {
+	record DNSRecord
+	// added is set for records the update adds, which persist appends to
+	// the records file.
+	added    bool
+	modified bool
+	removed  bool
+}
+
+func newRecordsEdit(config Config) *recordsEdit {
+	edit := &recordsEdit{sourced: config.sourced, defaultTTL: config.Server.DefaultTTL}
+	for _, record := range config.Records {
+		edit.entries = append(edit.entries, editEntry{record: record})
+	}
+	return edit
+}
+
+// existing returns the records currently held for name, including
+// client-specific view addresses.
+func (edit *recordsEdit) existing(name string) []dns.RR {
+	var rrs []dns.RR
+	records := slices.Clone(edit.sourced)
+	for _, e := range edit.entries {
+		if !e.removed {
+			records = append(records, e.record)
+		}
+	}
+	for _, record := range expandAliases(records) {
+		if owner, _ := ownerName(record.Hostname); owner != name {
+			continue
+		}
+		parsed, _ := parseRecord(record, name, edit.defaultTTL)
+		rrs = append(rrs, parsed...)
+		views, _ := parseViews(record, name, edit.defaultTTL)
+		for _, view := range views {
+			rrs = append(rrs, view.addresses...)
+		}
+	}
+	return rrs
+}
+
+// add adds rr unless it is already present or would conflict with a CNAME.
+// A CNAME replaces any CNAME already at the name.
+func (edit *recordsEdit) add(rr dns.RR) {
+	record, ok := recordFromRR(rr)
+	if !ok {
+		return
+	}
+	name := dns.CanonicalName(rr.Header().Name)
+	existing := edit.existing(name)
+	cnames := len(filterType(existing, dns.TypeCNAME))
+	switch {
+	case slices.ContainsFunc(existing, func(other dns.RR) bool { return dns.IsDuplicate(rr, other) }):
+		return
+	case rr.Header().Rrtype == dns.TypeCNAME && len(existing) > cnames:
+		return
+	case rr.Header().Rrtype != dns.TypeCNAME && cnames > 0:
+		return
+	case rr.Header().Rrtype == dns.TypeCNAME:
+		edit.deleteRRset(name, dns.TypeCNAME, "")
+	}
+	edit.entries = append(edit.entries, editEntry{record: record, added: true})
+	edit.changed = true
+}
+
+// deleteName removes every record at name, apart from the NS records at the
+// apex of zoneName.
+func (edit *recordsEdit) deleteName(name, zoneName string) {
+	edit.each(name, func(e *editEntry) {
+		if name == zoneName && strings.EqualFold(e.record.Type, "NS") {
+			return
+		}
+		edit.remove(e)
+	})
+}
+
+// deleteRRset removes the records of type rrtype at name. The NS records at
+// the apex of zoneName are kept.
+func (edit *recordsEdit) deleteRRset(name string, rrtype uint16, zoneName string) {
+	if rrtype == dns.TypeSOA || (rrtype == dns.TypeNS && name == zoneName) {
+		return
+	}
+	edit.each(name, func(e *editEntry) {
+		if isAddressRecord(e.record) && (rrtype == dns.TypeA || rrtype == dns.TypeAAAA) {
+			edit.dropIPs(e, func(ip net.IP) bool { return (ip.To4() != nil) == (rrtype == dns.TypeA) })
+		} else if strings.EqualFold(e.record.Type, dns.TypeToString[rrtype]) {
+			edit.remove(e)
+		}
+	})
+}
+
+// deleteRR removes the record matching rr, whose class is NONE, from name.
+func (edit *recordsEdit) deleteRR(name string, rr dns.RR, zoneName string) {
+	rrtype := rr.Header().Rrtype
+	if rrtype == dns.TypeSOA || (rrtype == dns.TypeNS && name == zoneName) {
+		return
+	}
+	match := dns.Copy(rr)
+	match.Header().Class = dns.ClassINET
+	edit.each(name, func(e *editEntry) {
+		if isAddressRecord(e.record) {
+			edit.dropIPs(e, func(ip net.IP) bool {
+				return dns.IsDuplicate(match, addressRecord(name, ip, 0))
+			})
+			return
+		}
+		parsed, err := parseRecord(e.record, name, 0)
+		if err == nil && slices.ContainsFunc(parsed, func(other dns.RR) bool { return dns.IsDuplicate(match, other) }) {
+			edit.remove(e)
+		}
+	})
+}
+
+// each calls fn for every record of the records file still held for name.
+// A record shared with aliases is handed to fn as a record for name alone,
+// and split off from the others only if fn changes it.
+func (edit *recordsEdit) each(name string, fn func(e *editEntry)) {
+	for i := range len(edit.entries) {
+		e := &edit.entries[i]
+		if e.removed || !e.record.owns(name) {
+			continue
+		}
+		if len(e.record.Aliases) == 0 {
+			fn(e)
+			continue
+		}
+		own := editEntry{record: e.record.only(name), added: true}
+		own.record.fileIndex = 0
+		changed := edit.changed
+		fn(&own)
+		if !own.removed && !own.modified {
+			edit.changed = changed
+			continue
+		}
+		e.record, _ = e.record.without(name)
+		e.modified = true
+		if !own.removed {
+			edit.entries = append(edit.entries, own)
+		}
+	}
+}
+
+func (edit *recordsEdit) remove(e *editEntry) {
+	e.removed = true
+	edit.changed = true
+}
+
+// dropIPs removes the addresses of e for which drop returns true. The record
+// is removed once it has no addresses or views left.
+func (edit *recordsEdit) dropIPs(e *editEntry, drop func(ip net.IP) bool) {
+	record := e.record
+	if ip := net.ParseIP(record.IP); ip != nil && drop(ip) {
+		record.IP = ""
+	}
+	record.IPs = slices.DeleteFunc(slices.Clone(record.IPs), func(w weightedIP) bool {
+		ip := net.ParseIP(w.IP)
+		return ip != nil && drop(ip)
+	})
+	if len(record.IPs) == 0 {
+		record.IPs = nil
+	}
+	if record.IP == e.record.IP && len(record.IPs) == len(e.record.IPs) {
+		return
+	}
+	if record.IP == "" && len(record.IPs) == 0 && len(record.Views) == 0 {
+		edit.remove(e)
+		return
+	}
+	e.record = record
+	e.modified = true
+	edit.changed = true
+}
+
+func isAddressRecord(record DNSRecord) bool {
+	switch strings.ToUpper(record.Type) {
+	case "", "A", "AAAA":
+		return true
+	}
+	return false
+}
+
+// records returns the records file's records after the edit.
+func (edit *recordsEdit) records() []DNSRecord {
+	var records []DNSRecord
+	for _, e := range edit.entries {
+		if !e.removed {
+			records = append(records, e.record)
+		}
+	}
+	return records
+}
+
+// persist rewrites the records sequence of the records file to match the
+// edit, keeping the nodes of unchanged records and the comments of changed
+// ones. Records that aren't in the file, such as ones added through the API
+// without persist, are left out of it however the update changes them.
+func (edit *recordsEdit) persist(seq *yaml.Node) error {
+	replace := make(map[int]*yaml.Node)
+	drop := make(map[int]bool)
+	var added []*yaml.Node
+	for _, e := range edit.entries {
+		pos := e.record.fileIndex - 1
+		switch {
+		case e.added && !e.removed:
+			node, err := recordNode(e.record, nil)
+			if err != nil {
+				return err
+			}
+			added = append(added, node)
+		case pos < 0:
+		case e.removed:
+			drop[pos] = true
+		case e.modified:
+			node, err := recordNode(e.record, seq.Content[pos])
+			if err != nil {
+				return err
+			}
+			replace[pos] = node
+		}
+	}
+
+	moved := rewriteRecords(seq, replace, drop, added)
+	next := len(seq.Content) - len(added)
+	for i := range edit.entries {
+		e := &edit.entries[i]
+		switch {
+		case e.added && !e.removed:
+			next++
+			e.record.fileIndex = next
+		case e.record.fileIndex > 0:
+			e.record.fileIndex = moved[e.record.fileIndex-1] + 1
+		}
+	}
+	edit.fileRecords = len(seq.Content)
+	return nil
+}
+
+// acceptMsg is the listeners' MsgAcceptFunc. dns.DefaultMsgAcceptFunc
+// answers every UPDATE with NOTIMP, since its sections can hold any number
+// of records, so updates are let through here. Queries with several
+// questions are passed on to the handler, which decides what to do with
+// them. Everything else is left to the default.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	const qr = 1 << 15
+	opcode := int(dh.Bits>>11) & 0xF
+	if opcode == dns.OpcodeUpdate && dh.Bits&qr == 0 {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	if opcode == dns.OpcodeQuery && dh.Qdcount > 1 {
+		dh.Qdcount = 1
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
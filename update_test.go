@@ -0,0 +1,212 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const updateRecords = `zones:
+  - name: lan
+    ns: ns.lan
+    serial: 10
+    allow_update: ["127.0.0.1"]
+records:
+  # the printer
+  - hostname: printer.lan
+    ip: 10.0.0.5
+  - hostname: nas.lan
+    ip: 10.0.0.6
+`
+
+// sendUpdate sends the update m from the client at ip and returns the
+// RCODE it gets.
+func sendUpdate(t *testing.T, res *Resolver, m *dns.Msg, ip string) int {
+	t.Helper()
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(ip), Port: 5353}}
+	res.handleDNSRequest(w, m)
+	if len(w.msgs) != 1 {
+		t.Fatalf("handler wrote %d replies, want 1", len(w.msgs))
+	}
+	return w.msgs[0].Rcode
+}
+
+// newUpdate returns an empty update to the zone lan.
+func newUpdate() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetUpdate("lan.")
+	return m
+}
+
+// TestUpdateAddDelete checks that additions and deletions are served and
+// written to the records file, keeping its comments, and that each update
+// raises the configured serial.
+func TestUpdateAddDelete(t *testing.T) {
+	res, path := newTestResolver(t, updateRecords)
+	m := newUpdate()
+	m.Insert([]dns.RR{mustRR(t, "laptop.lan. 300 IN A 10.0.0.42")})
+	m.RemoveRRset([]dns.RR{mustRR(t, "nas.lan. 0 IN A 0.0.0.0")})
+	if rcode := sendUpdate(t, res, m, "127.0.0.1"); rcode != dns.RcodeSuccess {
+		t.Fatalf("update: rcode %s", dns.RcodeToString[rcode])
+	}
+
+	if m := ask(t, res, "laptop.lan.", dns.TypeA); len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.0.42" {
+		t.Errorf("laptop.lan after the update: %v", m.Answer)
+	}
+	if m := ask(t, res, "nas.lan.", dns.TypeA); m.Rcode != dns.RcodeNameError {
+		t.Errorf("nas.lan after the update: rcode %s", dns.RcodeToString[m.Rcode])
+	}
+	if m := ask(t, res, "lan.", dns.TypeSOA); len(m.Answer) != 1 || m.Answer[0].(*dns.SOA).Serial != 11 {
+		t.Errorf("SOA after the update: %v, want serial 11", m.Answer)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := string(data)
+	for _, want := range []string{"# the printer", "printer.lan", "laptop.lan", "10.0.0.42", "serial: 11"} {
+		if !strings.Contains(file, want) {
+			t.Errorf("records file lacks %q:\n%s", want, file)
+		}
+	}
+	if strings.Contains(file, "nas.lan") {
+		t.Errorf("records file still holds nas.lan:\n%s", file)
+	}
+
+	// The file written by the update loads back to the same records.
+	if err := res.loadRecords(path); err != nil {
+		t.Fatal(err)
+	}
+	if m := ask(t, res, "laptop.lan.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("laptop.lan after reloading: %v", m.Answer)
+	}
+	if m := ask(t, res, "lan.", dns.TypeSOA); m.Answer[0].(*dns.SOA).Serial != 11 {
+		t.Errorf("SOA after reloading: %v", m.Answer)
+	}
+}
+
+// TestUpdatePrerequisites checks that an update whose prerequisites fail
+// changes nothing and gets the RCODE naming the failure.
+func TestUpdatePrerequisites(t *testing.T) {
+	res, _ := newTestResolver(t, updateRecords)
+	for _, tt := range []struct {
+		desc   string
+		prereq func(m *dns.Msg)
+		want   int
+	}{
+		{"rrset used", func(m *dns.Msg) { m.RRsetUsed([]dns.RR{mustRR(t, "printer.lan. 0 IN MX 10 mail.lan.")}) }, dns.RcodeNXRrset},
+		{"name not used", func(m *dns.Msg) { m.NameNotUsed([]dns.RR{mustRR(t, "printer.lan. 0 IN A 0.0.0.0")}) }, dns.RcodeYXDomain},
+		{"name used", func(m *dns.Msg) { m.NameUsed([]dns.RR{mustRR(t, "missing.lan. 0 IN A 0.0.0.0")}) }, dns.RcodeNameError},
+		{"rrset not used", func(m *dns.Msg) { m.RRsetNotUsed([]dns.RR{mustRR(t, "printer.lan. 0 IN A 0.0.0.0")}) }, dns.RcodeYXRrset},
+		{"rrset differs", func(m *dns.Msg) { m.Used([]dns.RR{mustRR(t, "printer.lan. 0 IN A 10.0.0.9")}) }, dns.RcodeNXRrset},
+	} {
+		m := newUpdate()
+		tt.prereq(m)
+		m.Insert([]dns.RR{mustRR(t, "laptop.lan. 300 IN A 10.0.0.42")})
+		if rcode := sendUpdate(t, res, m, "127.0.0.1"); rcode != tt.want {
+			t.Errorf("%s: rcode %s, want %s", tt.desc, dns.RcodeToString[rcode], dns.RcodeToString[tt.want])
+		}
+	}
+	if m := ask(t, res, "laptop.lan.", dns.TypeA); m.Rcode != dns.RcodeNameError {
+		t.Errorf("failed updates added laptop.lan: %v", m.Answer)
+	}
+	if m := ask(t, res, "lan.", dns.TypeSOA); m.Answer[0].(*dns.SOA).Serial != 10 {
+		t.Errorf("failed updates changed the serial: %v", m.Answer)
+	}
+}
+
+// TestUpdateACL checks that updates from clients outside allow_update are
+// refused, and updates outside a configured zone get NOTAUTH.
+func TestUpdateACL(t *testing.T) {
+	res, _ := newTestResolver(t, updateRecords)
+	m := newUpdate()
+	m.Insert([]dns.RR{mustRR(t, "laptop.lan. 300 IN A 10.0.0.42")})
+	if rcode := sendUpdate(t, res, m, "192.0.2.1"); rcode != dns.RcodeRefused {
+		t.Errorf("update from another client: rcode %s, want REFUSED", dns.RcodeToString[rcode])
+	}
+	if m := ask(t, res, "laptop.lan.", dns.TypeA); m.Rcode != dns.RcodeNameError {
+		t.Errorf("refused update added laptop.lan: %v", m.Answer)
+	}
+
+	m = new(dns.Msg)
+	m.SetUpdate("example.com.")
+	m.Insert([]dns.RR{mustRR(t, "www.example.com. 300 IN A 192.0.2.80")})
+	if rcode := sendUpdate(t, res, m, "127.0.0.1"); rcode != dns.RcodeNotAuth {
+		t.Errorf("update outside the zones: rcode %s, want NOTAUTH", dns.RcodeToString[rcode])
+	}
+}
+
+// TestUpdateAfterUnpersistedAdd checks that a record added through the API
+// without persist doesn't stop updates from being written, and stays out of
+// the records file.
+func TestUpdateAfterUnpersistedAdd(t *testing.T) {
+	res, path := newTestResolver(t, updateRecords)
+	api := &recordsAPI{res: res, path: path}
+	rec := httptest.NewRecorder()
+	api.add(rec, httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(`{"hostname": "tv.lan", "ip": "10.0.0.7"}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("API add: %d %s", rec.Code, rec.Body)
+	}
+
+	m := newUpdate()
+	m.Insert([]dns.RR{mustRR(t, "laptop.lan. 300 IN A 10.0.0.42")})
+	if rcode := sendUpdate(t, res, m, "127.0.0.1"); rcode != dns.RcodeSuccess {
+		t.Fatalf("update after an unpersisted add: rcode %s", dns.RcodeToString[rcode])
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file := string(data); !strings.Contains(file, "laptop.lan") || strings.Contains(file, "tv.lan") {
+		t.Errorf("records file after the update:\n%s", file)
+	}
+	for _, name := range []string{"tv.lan.", "laptop.lan.", "printer.lan."} {
+		if m := ask(t, res, name, dns.TypeA); len(m.Answer) != 1 {
+			t.Errorf("%s after the update: %v", name, m.Answer)
+		}
+	}
+
+	// A second update still lines up with the file.
+	m = newUpdate()
+	m.RemoveName([]dns.RR{mustRR(t, "printer.lan. 0 IN A 0.0.0.0")})
+	if rcode := sendUpdate(t, res, m, "127.0.0.1"); rcode != dns.RcodeSuccess {
+		t.Fatalf("second update: rcode %s", dns.RcodeToString[rcode])
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "printer.lan") {
+		t.Errorf("records file after the second update:\n%s", data)
+	}
+}
+
+// TestUpdateWithoutFile checks that with the records supplied by
+// DNS_RECORDS and no records file, updates are applied in memory.
+func TestUpdateWithoutFile(t *testing.T) {
+	t.Setenv(recordsEnv, "printer.lan=10.0.0.5")
+	res := NewResolver(slog.New(slog.DiscardHandler))
+	path := t.TempDir() + "/dns_records.yml"
+	if err := res.loadRecords(path); err != nil {
+		t.Fatal(err)
+	}
+	// Zones are only read from the records file, so set one directly.
+	config := res.currentConfig()
+	config.Zones = []ZoneConfig{{Name: "lan", NS: "ns.lan", AllowUpdate: []string{"127.0.0.1"}}}
+	res.applyConfig(config, path)
+
+	m := newUpdate()
+	m.Insert([]dns.RR{mustRR(t, "laptop.lan. 300 IN A 10.0.0.42")})
+	if rcode := sendUpdate(t, res, m, "127.0.0.1"); rcode != dns.RcodeSuccess {
+		t.Fatalf("update without a records file: rcode %s", dns.RcodeToString[rcode])
+	}
+	if m := ask(t, res, "laptop.lan.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("laptop.lan after the update: %v", m.Answer)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Error("the update created a records file")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay debounces bursts of filesystem events, such as the truncate
+// followed by a write that most editors produce on save.
+const reloadDelay = 200 * time.Millisecond
+
+// watchRecords reloads the records whenever path changes on disk. The parent
+// directory is watched rather than the file itself so that editors which
+// replace the file on save are still picked up.
+func (res *Resolver) watchRecords(path string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		var pending *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(path) {
+					continue
+				}
+				if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+					continue
+				}
+				if pending != nil {
+					pending.Stop()
+				}
+				pending = time.AfterFunc(reloadDelay, func() {
+					res.logger.Info("records file changed, reloading", "path", path)
+					res.loadRecords(path)
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				res.logger.Error("failed to watch records file", "path", path, "err", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadOnSignal reloads the records from path every time the process
+// receives SIGHUP.
+func (res *Resolver) reloadOnSignal(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			res.logger.Info("received SIGHUP, reloading")
+			res.loadRecords(path)
+		}
+	}()
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// ZoneConfig describes a zone this server is authoritative for. Leaving
+// Serial unset generates one that increases on every reload.
+type ZoneConfig struct {
+	Name    string  `yaml:"name"`
+	NS      string  `yaml:"ns"`
+	Admin   string  `yaml:"admin"`
+	Serial  uint32  `yaml:"serial"`
+	Refresh uint32  `yaml:"refresh"`
+	Retry   uint32  `yaml:"retry"`
+	Expire  uint32  `yaml:"expire"`
+	Minimum uint32  `yaml:"minimum"`
+	TTL     *uint32 `yaml:"ttl"`
+
+	AllowTransfer []string `yaml:"allow_transfer"`
+	AllowUpdate   []string `yaml:"allow_update"`
+	TransferKeys  []string `yaml:"transfer_keys"`
+	UpdateKeys    []string `yaml:"update_keys"`
+
+	DNSSEC DNSSECConfig `yaml:"dnssec"`
+}
+
+func defaultZoneConfig() ZoneConfig {
+	return ZoneConfig{
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  604800,
+		Minimum: 60,
+	}
+}
+
+func (z *ZoneConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain ZoneConfig
+	*z = defaultZoneConfig()
+	return value.Decode((*plain)(z))
+}
+
+// zone is a loaded zone: its SOA, the clients and TSIG keys allowed to
+// transfer it or send it dynamic updates, and for signed zones the signing
+// key and the names of its NSEC chain.
+type zone struct {
+	soa          *dns.SOA
+	transfer     []netip.Prefix
+	update       []netip.Prefix
+	transferKeys []string
+	updateKeys   []string
+
+	key   *zoneKey
+	names []string
+}
+
+// parseZone builds the zone described by cfg. previous is the zone loaded
+// under the same name before this reload, if any, and keeps generated
+// serials moving forward.
+func parseZone(cfg ZoneConfig, ttl uint32, previous *zone) (*zone, error) {
+	if _, ok := dns.IsDomainName(cfg.Name); !ok || cfg.Name == "" {
+		return nil, fmt.Errorf("invalid zone name %q", cfg.Name)
+	}
+	name := dns.CanonicalName(cfg.Name)
+	if cfg.NS == "" {
+		return nil, fmt.Errorf("zone %q: ns is required", cfg.Name)
+	}
+	ns, err := parseTarget(cfg.NS)
+	if err != nil {
+		return nil, fmt.Errorf("zone %q: %w", cfg.Name, err)
+	}
+
+	admin := cfg.Admin
+	if admin == "" {
+		admin = "hostmaster." + name
+	}
+	mbox, err := adminMailbox(admin)
+	if err != nil {
+		return nil, fmt.Errorf("zone %q: %w", cfg.Name, err)
+	}
+
+	if cfg.TTL != nil {
+		ttl = *cfg.TTL
+	}
+	serial := cfg.Serial
+	if serial == 0 {
+		serial = uint32(time.Now().Unix())
+		if previous != nil && serial <= previous.soa.Serial {
+			serial = previous.soa.Serial + 1
+		}
+	}
+	transfer, err := parsePrefixes(cfg.AllowTransfer)
+	if err != nil {
+		return nil, fmt.Errorf("zone %q: allow_transfer: %w", cfg.Name, err)
+	}
+	update, err := parsePrefixes(cfg.AllowUpdate)
+	if err != nil {
+		return nil, fmt.Errorf("zone %q: allow_update: %w", cfg.Name, err)
+	}
+
+	soa := &dns.SOA{
+		Hdr:     rrHeader(name, dns.TypeSOA, ttl),
+		Ns:      ns,
+		Mbox:    mbox,
+		Serial:  serial,
+		Refresh: cfg.Refresh,
+		Retry:   cfg.Retry,
+		Expire:  cfg.Expire,
+		Minttl:  cfg.Minimum,
+	}
+	return &zone{
+		soa:          soa,
+		transfer:     transfer,
+		update:       update,
+		transferKeys: keyNames(cfg.TransferKeys),
+		updateKeys:   keyNames(cfg.UpdateKeys),
+	}, nil
+}
+
+// keyNames returns the canonical form of the TSIG key names in names.
+func keyNames(names []string) []string {
+	var keys []string
+	for _, name := range names {
+		keys = append(keys, dns.CanonicalName(name))
+	}
+	return keys
+}
+
+// adminMailbox converts an email address such as "dns.admin@example.com" to
+// the SOA RNAME form "dns\.admin.example.com.". Names already in that form
+// are accepted as they are.
+func adminMailbox(admin string) (string, error) {
+	if local, domain, ok := strings.Cut(admin, "@"); ok {
+		admin = strings.ReplaceAll(local, ".", `\.`) + "." + domain
+	}
+	if _, ok := dns.IsDomainName(admin); !ok {
+		return "", fmt.Errorf("invalid admin %q", admin)
+	}
+	return dns.Fqdn(admin), nil
+}
+
+// enclosingZone returns the most specific configured zone that contains
+// name, or nil if name is outside every zone.
+func (res *Resolver) enclosingZone(name string) *zone {
+	return encloser(res.loaded().zones, dns.CanonicalName(name))
+}
+
+// authorityNames returns the names this server is authoritative at or
+// below: the configured zones, or without any, the parent of every record's
+// name. A name with records beneath it is taken to be their apex and covers
+// only itself, so a record for example.com doesn't claim all of com. Names
+// with a single label have no parent worth claiming and only cover
+// themselves.
+func authorityNames(zones map[string]*zone, records map[string]*hostRecords) map[string]bool {
+	names := make(map[string]bool)
+	for name := range zones {
+		names[name] = true
+	}
+	if len(names) > 0 {
+		return names
+	}
+	apexes := make(map[string]bool)
+	for name := range records {
+		for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+			apexes[name[off:]] = true
+		}
+	}
+	for name := range records {
+		if off, end := dns.NextLabel(name, 0); !end && dns.CountLabel(name) > 1 && !apexes[name] {
+			name = name[off:]
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// authoritative reports whether name is at or below one of the names the
+// server is authoritative for, so that a miss deserves NXDOMAIN rather than
+// REFUSED.
+func (res *Resolver) authoritative(name string) bool {
+	authority := res.loaded().authority
+	name = dns.CanonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if authority[name[off:]] {
+			return true
+		}
+	}
+	return false
+}
+
+// encloser returns the most specific of zones that contains the canonical
+// name, or nil.
+func encloser(zones map[string]*zone, name string) *zone {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if z, found := zones[name[off:]]; found {
+			return z
+		}
+	}
+	return nil
+}
+
+// delegation returns the NS records of the zone cut at or above q.Name when
+// a configured zone delegates the subdomain holding it to other servers, or
+// nil if this server answers for the name itself. Only names strictly below
+// a zone's apex can be cuts, since the NS records at the apex list this
+// server's own zone. The DS records at a cut belong to the parent and are
+// answered rather than referred.
+func (res *Resolver) delegation(q dns.Question) []dns.RR {
+	name := dns.CanonicalName(q.Name)
+	snap := res.loaded()
+	z := encloser(snap.zones, name)
+	if z == nil {
+		return nil
+	}
+	// The cut closest to the apex wins: everything below it belongs to
+	// the child zone, including any further delegations it makes.
+	var cut string
+	var nameservers []dns.RR
+	for off, end := 0, false; !end && name[off:] != z.soa.Hdr.Name; off, end = dns.NextLabel(name, off) {
+		if host, found := snap.records[name[off:]]; found {
+			if ns := filterType(host.records, dns.TypeNS); len(ns) > 0 {
+				cut, nameservers = name[off:], ns
+			}
+		}
+	}
+	if cut == name && q.Qtype == dns.TypeDS {
+		return nil
+	}
+	return nameservers
+}
+
+// negativeSOA returns the SOA to place in the authority section of a negative
+// answer, with its TTL capped at the zone minimum as RFC 2308 requires.
+func negativeSOA(soa *dns.SOA) dns.RR {
+	rr := dns.Copy(soa)
+	rr.Header().Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	return rr
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const delegationRecords = `zones:
+  - name: example.com
+    ns: ns1.example.com
+records:
+  - hostname: example.com
+    type: NS
+    target: ns1.example.com
+  - hostname: ns1.example.com
+    ip: 192.0.2.1
+  - hostname: www.example.com
+    ip: 192.0.2.80
+  - hostname: sub.example.com
+    type: NS
+    target: ns.sub.example.com
+  - hostname: sub.example.com
+    type: NS
+    target: ns1.other.net
+  - hostname: ns.sub.example.com
+    ip: 192.0.2.53
+`
+
+// TestDelegationReferral checks that names at or below a delegated
+// subdomain get a non-authoritative referral with glue, while the rest of
+// the zone is still answered authoritatively.
+func TestDelegationReferral(t *testing.T) {
+	res, _ := newTestResolver(t, delegationRecords)
+	for _, name := range []string{"host.sub.example.com.", "sub.example.com.", "a.b.sub.example.com.", "ns.sub.example.com."} {
+		m := ask(t, res, name, dns.TypeA)
+		if m.Rcode != dns.RcodeSuccess || m.Authoritative || len(m.Answer) != 0 {
+			t.Errorf("%s: rcode %s, aa %v, %d answers; want a referral", name, dns.RcodeToString[m.Rcode], m.Authoritative, len(m.Answer))
+			continue
+		}
+		if len(m.Ns) != 2 {
+			t.Fatalf("%s: authority %v, want the two NS records of sub.example.com", name, m.Ns)
+		}
+		for _, rr := range m.Ns {
+			if ns, ok := rr.(*dns.NS); !ok || ns.Hdr.Name != "sub.example.com." {
+				t.Errorf("%s: authority holds %v", name, rr)
+			}
+		}
+		if len(m.Extra) != 1 || m.Extra[0].(*dns.A).A.String() != "192.0.2.53" {
+			t.Errorf("%s: additional %v, want the glue for ns.sub.example.com", name, m.Extra)
+		}
+	}
+
+	m := ask(t, res, "www.example.com.", dns.TypeA)
+	if !m.Authoritative || len(m.Answer) != 1 {
+		t.Errorf("www.example.com: aa %v, %d answers", m.Authoritative, len(m.Answer))
+	}
+	m = ask(t, res, "missing.example.com.", dns.TypeA)
+	if !m.Authoritative || m.Rcode != dns.RcodeNameError {
+		t.Errorf("missing.example.com: aa %v, rcode %s", m.Authoritative, dns.RcodeToString[m.Rcode])
+	}
+	m = ask(t, res, "example.com.", dns.TypeNS)
+	if !m.Authoritative || len(m.Answer) == 0 {
+		t.Errorf("apex NS: aa %v, answers %v; the apex is not a cut", m.Authoritative, m.Answer)
+	}
+}
+
+// TestDelegationDS checks that DS queries at a cut are answered by the
+// parent rather than referred.
+func TestDelegationDS(t *testing.T) {
+	res, _ := newTestResolver(t, delegationRecords)
+	m := ask(t, res, "sub.example.com.", dns.TypeDS)
+	if !m.Authoritative || len(m.Ns) != 1 {
+		t.Fatalf("DS at the cut: aa %v, authority %v; want an authoritative answer with the SOA", m.Authoritative, m.Ns)
+	}
+	if _, ok := m.Ns[0].(*dns.SOA); !ok {
+		t.Errorf("DS at the cut: authority %v, want the zone's SOA", m.Ns)
+	}
+}
+
+// TestDelegationKeepsGlueWhenMinimal checks that minimal_responses leaves
+// the glue of a referral in place.
+func TestDelegationKeepsGlueWhenMinimal(t *testing.T) {
+	res, _ := newTestResolver(t, "server:\n  minimal_responses: true\n"+delegationRecords)
+	if m := ask(t, res, "host.sub.example.com.", dns.TypeA); len(m.Extra) != 1 {
+		t.Errorf("additional %v, want the glue", m.Extra)
+	}
+}
+
+// TestAuthorityWithoutZones checks which names get NXDOMAIN rather than
+// REFUSED when no zones are configured: a record's parent is claimed, but
+// never the parent of a name with records beneath it.
+func TestAuthorityWithoutZones(t *testing.T) {
+	res, _ := newTestResolver(t, `records:
+  - hostname: example.com
+    ip: 192.0.2.1
+  - hostname: www.example.com
+    ip: 192.0.2.80
+  - hostname: printer.lan
+    ip: 10.0.0.5
+  - hostname: router
+    ip: 10.0.0.1
+`)
+	for name, want := range map[string]int{
+		"missing.example.com.":   dns.RcodeNameError,
+		"a.www.example.com.":     dns.RcodeNameError,
+		"random.com.":            dns.RcodeRefused,
+		"scanner.lan.":           dns.RcodeNameError,
+		"other.":                 dns.RcodeRefused,
+		"missing.router.":        dns.RcodeNameError,
+		"www.example.com.other.": dns.RcodeRefused,
+	} {
+		if m := ask(t, res, name, dns.TypeA); m.Rcode != want {
+			t.Errorf("%s: rcode %s, want %s", name, dns.RcodeToString[m.Rcode], dns.RcodeToString[want])
+		}
+	}
+}